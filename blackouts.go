@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	h "github.com/xorpaul/gohelper"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// blackoutStatus marks a granted restart which was not executed, because a blackout started during
+// the negotiation
+const blackoutStatus = "blackout"
+
+// blackout is a one-off freeze period during which the client never requests a restart. end is
+// exclusive, so a blackout from 2026-12-20 to 2027-01-07 ends at the start of 2027-01-07.
+type blackout struct {
+	Start  string `yaml:"start"`
+	End    string `yaml:"end"`
+	Reason string `yaml:"reason"`
+	// Source is the config file or the file of blackouts_dir which contains the blackout
+	Source string `yaml:"-"`
+
+	start time.Time
+	end   time.Time
+}
+
+// parse validates the blackout and prepares it for the checks
+func (b *blackout) parse() error {
+	var err error
+	if b.start, err = parseTimestamp(b.Start); err != nil {
+		return errors.New("Invalid start: " + err.Error())
+	}
+	if b.end, err = parseTimestamp(b.End); err != nil {
+		return errors.New("Invalid end: " + err.Error())
+	}
+	if !b.end.After(b.start) {
+		return errors.New("end " + b.End + " must be after start " + b.Start)
+	}
+	if len(b.Reason) == 0 {
+		b.Reason = "reason not specified"
+	}
+	return nil
+}
+
+// String describes the blackout for log messages
+func (b blackout) String() string {
+	if b.start.IsZero() {
+		return "'" + b.Reason + "' (" + b.Source + ")"
+	}
+	return "'" + b.Reason + "' from " + b.start.Format(time.RFC3339) + " until " + b.end.Format(time.RFC3339) + " (" + b.Source + ")"
+}
+
+// contains checks if the time is inside of the blackout
+func (b blackout) contains(t time.Time) bool {
+	return !t.Before(b.start) && t.Before(b.end)
+}
+
+// readBlackoutsFile reads the list of blackouts from a file of blackouts_dir
+func readBlackoutsFile(file string) ([]blackout, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.New("Failed to read blackout file " + file + " Error: " + err.Error())
+	}
+	var blackouts []blackout
+	if err := yaml.UnmarshalStrict(data, &blackouts); err != nil {
+		return nil, errors.New("Failed to parse blackout file " + file + " Error: " + err.Error())
+	}
+	for i := range blackouts {
+		blackouts[i].Source = file
+		if err := blackouts[i].parse(); err != nil {
+			return nil, errors.New("Invalid blackout in " + file + ": " + err.Error())
+		}
+	}
+	return blackouts, nil
+}
+
+// loadBlackouts returns the blackouts of the config file and of all *.yml and *.yaml files in
+// blackouts_dir, which is read on each run so that config management can drop freeze files
+// without restarting the daemon. A file which can not be read or parsed is returned as blackout
+// without end, because we can not know which freeze it should have announced.
+func loadBlackouts() []blackout {
+	blackouts := append([]blackout{}, config.Blackouts...)
+	if len(config.BlackoutsDir) == 0 {
+		return blackouts
+	}
+	files, err := filepath.Glob(filepath.Join(config.BlackoutsDir, "*.yml"))
+	if err == nil {
+		var yamlFiles []string
+		yamlFiles, err = filepath.Glob(filepath.Join(config.BlackoutsDir, "*.yaml"))
+		files = append(files, yamlFiles...)
+	}
+	if err != nil {
+		// like a file which can not be parsed a blackouts_dir which can not be read is an active blackout
+		err = errors.New("Failed to glob blackouts_dir " + config.BlackoutsDir + " Error: " + err.Error())
+		h.Infof(err.Error())
+		return append(blackouts, blackout{Reason: err.Error(), Source: config.BlackoutsDir, end: time.Unix(1<<62, 0)})
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		fileBlackouts, err := readBlackoutsFile(file)
+		if err != nil {
+			h.Infof(err.Error())
+			fileBlackouts = []blackout{{Reason: err.Error(), Source: file, end: time.Unix(1<<62, 0)}}
+		}
+		blackouts = append(blackouts, fileBlackouts...)
+	}
+	return blackouts
+}
+
+// activeBlackout returns the blackout which contains the time and if there is one. If several
+// blackouts overlap the one which ends last is returned.
+func activeBlackout(t time.Time) (blackout, bool) {
+	var active blackout
+	found := false
+	for _, b := range loadBlackouts() {
+		if b.contains(t) && (!found || b.end.After(active.end)) {
+			active = b
+			found = true
+		}
+	}
+	return active, found
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestActiveBlackout(t *testing.T) {
+	savedConfig := config
+	defer func() { config = savedConfig }()
+
+	config.BlackoutsDir = "./tests/TestBlackouts"
+	config.Blackouts = []blackout{{Start: "2026-12-24T00:00:00Z", End: "2027-01-10T00:00:00Z", Reason: "extended freeze", Source: "client.yml"}}
+	if err := config.Blackouts[0].parse(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		at             time.Time
+		expectedReason string
+	}{
+		{time.Date(2026, 12, 19, 23, 59, 0, 0, time.Local), ""},
+		{time.Date(2026, 12, 20, 0, 0, 0, 0, time.Local), "holiday change freeze"},
+		{time.Date(2026, 12, 28, 12, 0, 0, 0, time.UTC), "extended freeze"},
+		{time.Date(2027, 1, 9, 12, 0, 0, 0, time.UTC), "extended freeze"},
+		{time.Date(2027, 1, 10, 0, 0, 0, 0, time.UTC), ""},
+		{time.Date(2027, 3, 1, 7, 0, 0, 0, time.UTC), "product launch"},
+		{time.Date(2027, 3, 1, 19, 0, 0, 0, time.UTC), ""},
+	}
+	for _, test := range tests {
+		b, active := activeBlackout(test.at)
+		if active != (len(test.expectedReason) > 0) || b.Reason != test.expectedReason {
+			t.Errorf("activeBlackout(%s) returned %s %t, but we expected %q", test.at, b, active, test.expectedReason)
+		}
+	}
+
+	// a broken blackout file blocks restarts until it is fixed
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "broken.yml"), []byte("- start: next week\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config.BlackoutsDir = dir
+	config.Blackouts = nil
+	if b, active := activeBlackout(time.Now()); !active || !strings.Contains(b.Reason, "broken.yml") {
+		t.Errorf("activeBlackout returned %s %t, but we expected the broken blackout file", b, active)
+	}
+}
+
+func TestBlackoutInvalid(t *testing.T) {
+	tests := []blackout{
+		{},
+		{Start: "2026-12-20"},
+		{Start: "2026-12-20", End: "after christmas"},
+		{Start: "2027-01-07", End: "2026-12-20"},
+		{Start: "2026-12-20", End: "2026-12-20"},
+	}
+	for _, b := range tests {
+		if err := b.parse(); err == nil {
+			t.Errorf("parse() accepted invalid blackout %+v", b)
+		}
+	}
+}
+
+func TestRestartDuringBlackout(t *testing.T) {
+	savedConfig := config
+	defer func() { config = savedConfig }()
+	queueFakeRestartResponses()
+
+	config.Blackouts = []blackout{{Start: time.Now().Add(-time.Hour).Format(time.RFC3339), End: time.Now().Add(time.Hour).Format(time.RFC3339), Reason: "product launch"}}
+	if err := config.Blackouts[0].parse(); err != nil {
+		t.Fatal(err)
+	}
+	if exitCode := doMain(context.Background()); exitCode != exitCodeBlackout {
+		t.Errorf("doMain returned exit code %d, but we expected %d", exitCode, exitCodeBlackout)
+	}
+	fakeMutex.Lock()
+	defer fakeMutex.Unlock()
+	if len(fakeRestartRequestIDs) != 0 {
+		t.Errorf("service received %d restart requests during the blackout", len(fakeRestartRequestIDs))
+	}
+}
+
+func TestBlackoutStartedAfterGoAhead(t *testing.T) {
+	savedConfig := config
+	defer func() { config = savedConfig }()
+	config.StateFile = filepath.Join(t.TempDir(), "state.json")
+	queueFakeRestartResponses("tests/goahead-true.json")
+	fakeMutex.Lock()
+	fakeAbortReports = nil
+	fakeMutex.Unlock()
+
+	config.Blackouts = []blackout{{Start: "2026-10-19T04:00:00Z", End: "2026-10-20T00:00:00Z", Reason: "product launch"}}
+	if err := config.Blackouts[0].parse(); err != nil {
+		t.Fatal(err)
+	}
+	// the blackout starts after the restart was requested
+	fakeNow(t, time.Date(2026, 10, 19, 3, 59, 0, 0, time.UTC), time.Date(2026, 10, 19, 4, 0, 0, 0, time.UTC))
+
+	if exitCode := doRestart(context.Background(), testReasons); exitCode != exitCodeBlackout {
+		t.Errorf("doRestart returned exit code %d, but we expected %d", exitCode, exitCodeBlackout)
+	}
+	// the service releases the cluster lock after the abort report
+	fakeMutex.Lock()
+	if len(fakeAbortReports) != 1 || fakeAbortReports[0].RequestID != "sqEALyco" || fakeAbortReports[0].Phase != "blackout" || !strings.Contains(fakeAbortReports[0].Output, "product launch") {
+		t.Errorf("service received the abort reports %+v, but we expected one for the blackout", fakeAbortReports)
+	}
+	fakeMutex.Unlock()
+	if state, err := readRestartState(config.StateFile); err != nil || state.Status != blackoutStatus {
+		t.Errorf("persisted state is %+v with error %v, but we expected the status %s", state, err, blackoutStatus)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xorpaul/goahead_client/goahead"
+	h "github.com/xorpaul/gohelper"
+)
+
+// runPostRestartChecks executes the scripts of os_post_restart_checks_dir in lexical order and
+// retries the failed ones every os_post_restart_checks_interval until all of them passed or
+// os_post_restart_checks_deadline is reached. It returns nil if no checks are configured.
+func runPostRestartChecks(ctx context.Context) (*goahead.PostRestartChecksResult, error) {
+	if len(config.OsPostRestartChecksDir) == 0 {
+		return nil, nil
+	}
+	scripts, err := findScripts(config.OsPostRestartChecksDir)
+	if err != nil {
+		return nil, errors.New("Failed to glob post restart check directory " + config.OsPostRestartChecksDir + " Error: " + err.Error())
+	}
+	if len(scripts) == 0 {
+		h.Infof("Could not find any post restart check scripts in " + config.OsPostRestartChecksDir)
+		return nil, nil
+	}
+
+	start := time.Now()
+	deadline := start.Add(config.OsPostRestartChecksDeadline)
+	result := &goahead.PostRestartChecksResult{}
+	for _, script := range scripts {
+		result.Checks = append(result.Checks, goahead.PostRestartCheck{Name: filepath.Base(script)})
+	}
+
+	for {
+		result.Rounds++
+		result.Passed = true
+		for i, script := range scripts {
+			check := &result.Checks[i]
+			if check.Passed {
+				continue
+			}
+			sr := runScript(ctx, script, config.OsPostRestartChecksTimeout)
+			check.Attempts++
+			check.ReturnCode = sr.ReturnCode
+			check.Output = strings.TrimSpace(sr.Output)
+			if sr.Err != nil {
+				check.Output = strings.TrimSpace(sr.Err.Error() + " " + check.Output)
+			}
+			check.Passed = sr.Err == nil && sr.ReturnCode == 0
+			if !check.Passed {
+				result.Passed = false
+				h.Debugf("Post restart check " + script + " failed with exit code " + strconv.Itoa(sr.ReturnCode) + " during attempt " + strconv.Itoa(check.Attempts))
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+
+		if result.Passed || ctx.Err() != nil || time.Now().Add(config.OsPostRestartChecksInterval).After(deadline) {
+			break
+		}
+		h.Infof("Not all post restart checks passed, trying again in " + config.OsPostRestartChecksInterval.String())
+		select {
+		case <-ctx.Done():
+		case <-time.After(config.OsPostRestartChecksInterval):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	result.Duration = time.Since(start).Round(time.Millisecond).String()
+
+	if result.Passed {
+		h.Infof("All post restart checks passed after " + result.Duration)
+	} else {
+		var failed []string
+		for _, check := range result.Checks {
+			if !check.Passed {
+				failed = append(failed, check.Name)
+			}
+		}
+		h.Infof("Post restart checks failed after " + result.Duration + ": " + strings.Join(failed, " "))
+	}
+	return result, nil
+}
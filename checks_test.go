@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	H "github.com/xorpaul/gohelper"
+)
+
+func TestRunPostRestartChecks(t *testing.T) {
+	savedConfig := config
+	defer func() { config = savedConfig }()
+	H.PurgeDir("/var/tmp/goahead_client/post_restart_check_attempted", H.FuncName())
+
+	config.OsPostRestartChecksDir = "./tests/TestPostRestartChecks/"
+	config.OsPostRestartChecksDeadline = 10 * time.Second
+	config.OsPostRestartChecksInterval = 10 * time.Millisecond
+
+	result, err := runPostRestartChecks(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result == nil || !result.Passed {
+		t.Fatalf("post restart checks should pass during the second round, got %+v", result)
+	}
+	if result.Rounds != 2 {
+		t.Errorf("post restart checks took %d rounds, but we expected 2", result.Rounds)
+	}
+	expectedAttempts := map[string]int{"001_always_true.sh": 1, "100_second_attempt.sh": 2}
+	for _, check := range result.Checks {
+		if check.Attempts != expectedAttempts[check.Name] {
+			t.Errorf("check %s was executed %d times, but we expected %d", check.Name, check.Attempts, expectedAttempts[check.Name])
+		}
+	}
+}
+
+func TestRunPostRestartChecksFailing(t *testing.T) {
+	savedConfig := config
+	defer func() { config = savedConfig }()
+
+	config.OsPostRestartChecksDir = "./tests/TestPostRestartChecksFailing/"
+	config.OsPostRestartChecksDeadline = 100 * time.Millisecond
+	config.OsPostRestartChecksInterval = 10 * time.Millisecond
+
+	result, err := runPostRestartChecks(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result == nil || result.Passed {
+		t.Fatalf("post restart checks should fail, got %+v", result)
+	}
+	if result.Rounds < 2 {
+		t.Errorf("failing post restart checks should be retried until the deadline, but only %d rounds were made", result.Rounds)
+	}
+	if result.Checks[0].Passed || result.Checks[0].ReturnCode != 3 || !result.Checks[1].Passed || result.Checks[1].Attempts != 1 {
+		t.Errorf("unexpected check results %+v", result.Checks)
+	}
+}
+
+func TestRunPostRestartChecksTimeout(t *testing.T) {
+	savedConfig := config
+	defer func() { config = savedConfig }()
+
+	config.OsPostRestartChecksDir = "./tests/TestPostRestartChecksTimeout/"
+	config.OsPostRestartChecksDeadline = 0
+	config.OsPostRestartChecksTimeout = 100 * time.Millisecond
+
+	start := time.Now()
+	result, err := runPostRestartChecks(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result == nil || result.Passed || result.Checks[0].ReturnCode != -1 || !strings.Contains(result.Checks[0].Output, "killed after timeout of 100ms") {
+		t.Fatalf("hanging post restart check should be killed after the timeout, got %+v", result)
+	}
+	if time.Since(start) > 3*time.Second {
+		t.Errorf("hanging post restart check was killed after %s, but we expected 100ms", time.Since(start))
+	}
+}
+
+func TestReportRestartDoneWithPostRestartChecks(t *testing.T) {
+	savedConfig := config
+	defer func() { config = savedConfig }()
+	config.StateFile = filepath.Join(t.TempDir(), "state.json")
+	config.OsPostRestartChecksDir = "./tests/TestPostRestartChecksFailing/"
+	config.OsPostRestartChecksDeadline = 0
+	fakeMutex.Lock()
+	fakeReports = nil
+	fakeMutex.Unlock()
+
+	granted := restartState{RequestID: "sqEALyco", Status: "granted", BootID: "6f1c2f1c-5d4a-4a8e-9a55-0d6c1b0b2b11", Uptime: "87600h0m0s"}
+	if err := writeRestartState(config.StateFile, granted); err != nil {
+		t.Fatal(err)
+	}
+	reportRestartDone(context.Background())
+
+	fakeMutex.Lock()
+	defer fakeMutex.Unlock()
+	if len(fakeReports) != 1 || fakeReports[0].HealthChecks == nil {
+		t.Fatalf("service should have received a report with health checks, got %+v", fakeReports)
+	}
+	if healthChecks := fakeReports[0].HealthChecks; healthChecks.Passed || len(healthChecks.Checks) != 2 || healthChecks.Checks[0].Name != "001_failing.sh" {
+		t.Errorf("service received health checks %+v, but we expected the failed 001_failing.sh", healthChecks)
+	}
+}
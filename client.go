@@ -1,21 +1,18 @@
 package main
 
 import (
-	"bytes"
-	"crypto/tls"
-	"crypto/x509"
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/xorpaul/goahead_client/goahead"
 	h "github.com/xorpaul/gohelper"
 )
 
@@ -25,110 +22,114 @@ var (
 	info      bool
 	quiet     bool
 	buildtime string
-	config    configSettings
-	client    *http.Client
+	// dryRun negotiates the restart, but only prints the restart hooks instead of executing them
+	dryRun bool
+	config configSettings
+	client *goahead.Client
 )
 
-type request struct {
-	Fqdn          string `json:"fqdn"`
-	Uptime        string `json:"uptime"`
-	RequestID     string `json:"request_id,omitempty"`
-	RestartReason string `json:"restart_reason"`
-}
-
-type response struct {
-	Error          string    `json:"error"`
-	Timestamp      time.Time `json:"timestamp"`
-	Goahead        bool      `json:"go_ahead"`
-	UnknownHost    bool      `json:"unknown_host"`
-	AskagainIn     string    `json:"ask_again_in"`
-	RequestID      string    `json:"request_id"`
-	FoundCluster   string    `json:"found_cluster"`
-	RequestingFqdn string    `json:"requesting_fqdn"`
-	Message        string    `json:"message"`
-}
+// restartOutcome is the terminal state of a restart negotiation with the goahead service
+type restartOutcome int
+
+const (
+	restartGranted restartOutcome = iota
+	restartDenied
+	restartUnknownHost
+	restartServiceError
+	restartDeadlineExceeded
+	restartMaxAttemptsReached
+	restartAborted
+	restartPending
+)
 
-func inquireRestart() {
-	url := config.ServiceUrl + "v1/inquire/restart/"
-	body := doRequest(url, "", "inquire")
-	var response response
-	err := json.Unmarshal(body, &response)
-	if err != nil {
-		h.Warnf("Could not parse JSON response: " + string(body) + " Error: " + err.Error())
-	}
-	if len(response.Error) > 1 {
-		h.Fatalf("Recieved error: " + response.Error)
-		h.Infof("Received valid response from " + url)
-	}
+// exit codes of the goahead client, 1 is used for all other errors (h.Fatalf)
+const (
+	exitCodeOK                 = 0
+	exitCodeDenied             = 3
+	exitCodeUnknownHost        = 4
+	exitCodeServiceError       = 5
+	exitCodeDeadlineExceeded   = 6
+	exitCodeMaxAttemptsReached = 7
+	exitCodeAborted            = 8
+	exitCodeConditionError     = 9
+	exitCodeRestartNeeded      = 10
+	// exitCodeOutsideMaintenanceWindow is used if no restart was requested or executed, because
+	// none of the maintenance_windows is open
+	exitCodeOutsideMaintenanceWindow = 11
+	// exitCodeBlackout is used if no restart was requested or executed, because of an active blackout
+	exitCodeBlackout = 12
+	// exitCodeDryRunGranted is used if a dry run received the go ahead, to tell it apart from a dry run
+	// which found no restart reason
+	exitCodeDryRunGranted = 13
+	// exitCodeRestartHooksFailed is used if a restart hook failed and the restart was aborted
+	exitCodeRestartHooksFailed = 1
+)
 
-	if strings.HasPrefix(response.Message, "YesInquireToRestart") {
-		h.Infof("Received reason from middle-ware to restart: " + response.Message)
-		doRestart("forced by middle-ware")
+func (o restartOutcome) String() string {
+	switch o {
+	case restartGranted:
+		return "granted"
+	case restartDenied:
+		return "denied"
+	case restartUnknownHost:
+		return "unknown_host"
+	case restartServiceError:
+		return "error"
+	case restartDeadlineExceeded:
+		return "deadline_exceeded"
+	case restartMaxAttemptsReached:
+		return "max_attempts_reached"
+	case restartAborted:
+		return "aborted"
 	}
-
+	return "pending"
 }
 
-func askForOSRestart(rid string, restartReason string) response {
-	url := config.ServiceUrl + "v1/request/restart/os"
-	body := doRequest(url, rid, restartReason)
-	var response response
-	err := json.Unmarshal(body, &response)
-	if err != nil {
-		h.Warnf("Could not parse JSON response: " + string(body) + " Error: " + err.Error())
+func (o restartOutcome) exitCode() int {
+	switch o {
+	case restartDenied:
+		return exitCodeDenied
+	case restartUnknownHost:
+		return exitCodeUnknownHost
+	case restartServiceError:
+		return exitCodeServiceError
+	case restartDeadlineExceeded:
+		return exitCodeDeadlineExceeded
+	case restartMaxAttemptsReached:
+		return exitCodeMaxAttemptsReached
+	case restartAborted:
+		return exitCodeAborted
 	}
-	if len(response.Error) > 1 {
-		h.Fatalf("Recieved error: " + response.Error)
-	}
-	h.Infof("Received valid response from " + url)
-	return response
+	return exitCodeOK
 }
 
-func getPayload(rid string, restartReason string) *bytes.Buffer {
-	var req request
-
-	if len(rid) > 0 {
-		req.RequestID = rid
-	}
-	if len(restartReason) > 0 {
-		req.RestartReason = restartReason
-	}
-	if flag.Lookup("test.v") == nil {
-		req.Fqdn = getPayloadFqdn()
-		req.Uptime = getPayloadUptime()
-	} else {
-		req.Fqdn = "foobar-server-aa02.domain.tld"
-		if os.Getenv("TEST_FOR_CRASH_TestUptimeLow") == "1" {
-			req.Uptime = (time.Duration(2) * time.Second).String()
-		} else {
-			req.Uptime = (time.Duration(83836) * time.Second).String()
-		}
-	}
-
-	reqBytes, err := json.Marshal(req)
+func inquireRestart(ctx context.Context) int {
+	response, err := client.Inquire(ctx)
 	if err != nil {
-		h.Fatalf("Error while json.Marshal request. Error: " + err.Error())
+		h.Infof(err.Error())
+		return restartServiceError.exitCode()
 	}
 
-	h.Debugf("Trying to send payload: " + string(reqBytes))
-
-	return bytes.NewBuffer(reqBytes)
+	if strings.HasPrefix(response.Message, "YesInquireToRestart") {
+		h.Infof("Received reason from middle-ware to restart: " + response.Message)
+		return doRestart(ctx, []goahead.RestartReason{{Source: "goahead", Reason: "forced by middle-ware"}})
+	}
+	return exitCodeOK
 }
 
-func doRequest(url string, rid string, restartReason string) []byte {
-	h.Debugf("sending HTTP request " + url)
-	payload := getPayload(rid, restartReason)
-	resp, err := client.Post(url, "application/json", payload)
-	if err != nil {
-		h.Fatalf("Error while issuing request to " + url + " Error: " + err.Error())
+// askForOSRestart requests the restart from the goahead service. Failed requests are returned
+// as response with the Error field set. A request_id is only known to the server that issued it,
+// so a given serviceURL restricts the request to this server.
+func askForOSRestart(ctx context.Context, serviceURL string, rid string, restartReasons []goahead.RestartReason) goahead.Response {
+	c := client
+	if len(serviceURL) > 0 {
+		c = client.WithServiceURL(serviceURL)
 	}
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		h.Fatalf("Error while reading response body: " + err.Error())
+	response, err := c.RequestRestart(ctx, restartReasons, rid)
+	if err != nil && len(response.Error) == 0 {
+		response.Error = err.Error()
 	}
-	h.Debugf("Received response: " + string(body))
-
-	return body
-
+	return response
 }
 
 func main() {
@@ -138,8 +139,11 @@ func main() {
 		configFileFlag   = flag.String("config", "/etc/goahead/client.yml", "which config file to use")
 		disabledFileFlag = flag.String("disabled", "/etc/goahead/disabled", "file to check if goahead run should be skipped")
 		versionFlag      = flag.Bool("version", false, "show build time and version number")
+		daemonFlag       = flag.Bool("daemon", false, "keep running and check for restarts every daemon_interval")
 	)
 	flag.BoolVar(&debug, "debug", false, "log debug output, defaults to false")
+	flag.BoolVar(&dryRun, "dry-run", false, "negotiate the restart, but only print the restart hooks which would be executed")
+	flag.Usage = printUsage
 	flag.Parse()
 
 	configFile := *configFileFlag
@@ -147,7 +151,7 @@ func main() {
 	version := *versionFlag
 
 	if version {
-		fmt.Println("goahead client version 0.0.3 Build time:", buildtime, "UTC")
+		printVersion()
 		os.Exit(0)
 	}
 
@@ -156,104 +160,213 @@ func main() {
 	h.InfoTimestamp = true
 	h.WarnExit = true
 
-	h.Debugf("Using as config file: " + configFile)
-	config = readConfigfile(configFile)
-	client = setupHttpClient()
-	if h.FileExists(disabledFile) {
-		data, err := os.ReadFile(disabledFile)
-		if err != nil {
-			h.Fatalf("There was an error parsing the file to disabled goahead" + disabledFile + ": " + err.Error())
-		}
-		reason := "reason not specified"
-		if len(data) > 0 {
-			reason = string(data)
-			reason = strings.ReplaceAll(reason, "\n", "")
-		}
-		fmt.Printf("Notice: Skipping run of goahead client; administratively disabled (Reason: '%s')\n", reason)
-	} else {
-		doMain()
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args(), &commandOptions{configFile: configFile, disabledFile: disabledFile}))
+	}
+
+	loadConfig(configFile)
+	if *daemonFlag {
+		runDaemon(configFile, disabledFile)
+	} else if !isDisabled(disabledFile) {
+		os.Exit(doMain(context.Background()))
 	}
 
 }
 
-func setupHttpClient() *http.Client {
-	// Get the SystemCertPool, continue with an empty pool on error
-	rootCAs, _ := x509.SystemCertPool()
-	if rootCAs == nil {
-		rootCAs = x509.NewCertPool()
-	}
+func printVersion() {
+	fmt.Println("goahead client version 0.0.3 Build time:", buildtime, "UTC")
+}
 
-	if len(config.ServiceUrlCaFile) > 0 {
-		// Read in the cert file
-		certs, err := os.ReadFile(config.ServiceUrlCaFile)
-		if err != nil {
-			h.Fatalf("Failed to append " + config.ServiceUrlCaFile + " to RootCAs Error: " + err.Error())
-		}
+// loadConfig reads the config file and creates the client for the goahead service
+func loadConfig(configFile string) {
+	h.Debugf("Using as config file: " + configFile)
+	config = readConfigfile(configFile)
+	client = setupClient()
+}
 
-		// Append our cert to the system pool
-		h.Debugf("Appending certificate " + config.ServiceUrlCaFile + " to trusted CAs")
-		if ok := rootCAs.AppendCertsFromPEM(certs); !ok {
-			h.Debugf("No certs appended, using system certs only")
-		}
+// setupClient creates the client for the goahead service from the config settings
+func setupClient() *goahead.Client {
+	c, err := newClient(config)
+	if err != nil {
+		h.Fatalf(err.Error())
 	}
+	return c
+}
 
-	// Trust the augmented cert pool in our client
-	tlsConfig := &tls.Config{
-		RootCAs: rootCAs,
+func newClient(config configSettings) (*goahead.Client, error) {
+	fqdn, err := getPayloadFqdn()
+	if err != nil {
+		return nil, err
 	}
-	tr := &http.Transport{TLSClientConfig: tlsConfig}
-	return &http.Client{Transport: tr}
+	return goahead.New(goahead.Config{
+		ServiceURL:               config.ServiceUrl,
+		ServiceURLs:              config.ServiceUrls,
+		ShuffleServiceURLs:       config.ServiceUrlSelection == "random",
+		ServiceSRV:               config.ServiceSrv,
+		ServiceSRVScheme:         config.ServiceSrvScheme,
+		ServiceSRVResolver:       config.ServiceSrvResolver,
+		CAFile:                   config.ServiceUrlCaFile,
+		CertificateFile:          config.CertificateFile,
+		PrivateKeyFile:           config.PrivateKey,
+		PrivateKeyPassphrase:     config.PrivateKeyPassphrase,
+		RequireClientCertificate: config.RequireAndVerifyClientCert,
+		Fqdn:                     fqdn,
+		Uptime:                   getUptime,
+		Facts:                    getPayloadFacts,
+		DryRun:                   dryRun,
+		Timeout:                  config.Timeout,
+		RequestDeadline:          config.RequestDeadline,
+		MaxRetries:               config.RequestRetries,
+		BackoffMin:               config.RetryBackoffMin,
+		BackoffMax:               config.RetryBackoffMax,
+		Debugf:                   h.Debugf,
+		Infof:                    h.Infof,
+	})
 }
 
-func doMain() {
-	er := h.ExecuteCommand(config.RestartConditionScript, 5, true)
-	if er.ReturnCode == config.RestartConditionScriptExitCodeForReboot {
-		doRestart(er.Output)
+// doMain checks for a local restart condition and negotiates the restart with the goahead service.
+// It returns the exit code of the terminal state that was reached.
+func doMain(ctx context.Context) int {
+	if dryRun {
+		h.Infof("Dry run: the restart is negotiated with the goahead service, but no restart hooks are executed")
 	} else {
-		h.Infof("Did not find local reason to restart. Asking if I should restart, because of other reasons.")
-		inquireRestart()
+		reportRestartDone(ctx)
 	}
-}
 
-func doRestart(restartReason string) {
-	response := askForOSRestart("", restartReason)
-	if len(response.FoundCluster) < 1 || len(response.AskagainIn) == 0 {
-		h.Warnf(response.Message + " Exiting...")
+	reasons, failed := collectRestartReasons(ctx)
+	// the restart condition is still checked during a blackout to log the found restart reasons
+	if b, active := activeBlackout(now()); active {
+		h.Infof("Found " + strconv.Itoa(len(reasons)) + " restart reasons, but not asking for a restart during blackout " + b.String() + " Exiting...")
+		return exitCodeBlackout
 	}
-	h.Infof("Sleeping for " + response.AskagainIn)
-	sleep, err := time.ParseDuration(response.AskagainIn)
-	if err != nil {
-		h.Fatalf("Error while trying to parse response.AskagainIn to Duration. Error: " + err.Error())
+	if len(reasons) > 0 {
+		return doRestart(ctx, reasons)
+	} else if failed {
+		h.Infof("Could not determine if a restart is needed, because restart condition scripts failed. Exiting...")
+		return exitCodeConditionError
+	} else {
+		h.Infof("Did not find local reason to restart. Asking if I should restart, because of other reasons.")
+		return inquireRestart(ctx)
 	}
-	time.Sleep(sleep)
-	response = askForOSRestart(response.RequestID, restartReason)
+}
 
-	if response.Goahead {
+// doRestart negotiates the restart with the goahead service and executes the restart hooks
+// if the go ahead was given
+func doRestart(ctx context.Context, restartReasons []goahead.RestartReason) int {
+	if open, next := maintenanceWindowOpen(now()); !open {
+		h.Infof("Not asking for a restart outside of the maintenance windows, " + formatNextMaintenanceWindow(next) + " Exiting...")
+		return exitCodeOutsideMaintenanceWindow
+	}
+	outcome, response := negotiateRestart(ctx, restartReasons)
+	switch outcome {
+	case restartGranted:
+		// a blackout might have started during the negotiation
+		if b, active := activeBlackout(now()); active {
+			message := "Received go ahead to restart, but blackout " + b.String() + " started in the meantime, not executing any restart hooks."
+			h.Infof(message + " Exiting...")
+			reportRestartAborted(context.WithoutCancel(ctx), response, goahead.RestartAbortedReport{Phase: "blackout", Output: message}, blackoutStatus)
+			return exitCodeBlackout
+		}
+		// the negotiation might have taken longer than the maintenance window
+		if open, next := maintenanceWindowOpen(now()); !open {
+			message := "Received go ahead to restart, but the maintenance window closed in the meantime, not executing any restart hooks, " + formatNextMaintenanceWindow(next)
+			h.Infof(message + " Exiting...")
+			reportRestartAborted(context.WithoutCancel(ctx), response, goahead.RestartAbortedReport{Phase: "maintenance_window", Output: message}, maintenanceWindowClosedStatus)
+			return exitCodeOutsideMaintenanceWindow
+		}
+		if dryRun {
+			printRestartHooks()
+			return exitCodeDryRunGranted
+		}
 		// execute hooks and check their exit code
-		executeRestartHooks()
-	} else {
-		h.Infof("Did not recieve go ahead to restart. Reason: " + response.Message)
+		return executeRestartHooks(ctx, response)
+	case restartDenied:
+		h.Infof("Restart request was denied: " + response.Message + " Exiting...")
+	case restartUnknownHost:
+		h.Infof("goahead service does not know this host: " + response.Message + " Exiting...")
+	case restartServiceError:
+		h.Infof("Recieved error: " + response.Error + " Exiting...")
+	case restartDeadlineExceeded:
+		h.Infof("Did not recieve go ahead to restart within restart_request_deadline " + config.RestartRequestDeadline.String() + ". Last message: " + response.Message)
+	case restartMaxAttemptsReached:
+		h.Infof("Did not recieve go ahead to restart after " + strconv.Itoa(config.RestartRequestMaxAttempts) + " attempts. Last message: " + response.Message)
+	case restartAborted:
+		h.Infof("Aborted restart request with request_id " + response.RequestID)
 	}
-
+	return outcome.exitCode()
 }
 
-func executeRestartHooks() {
-	if len(config.OsRestartHooksDir) > 0 {
-		if h.IsDir(config.OsRestartHooksDir) {
-			globPath := filepath.Join(config.OsRestartHooksDir, "*")
-			h.Debugf("Glob'ing with path " + globPath)
-			matches, err := filepath.Glob(globPath)
-			if len(matches) == 0 {
-				h.Fatalf("Could not find any restart hook scripts matching " + globPath)
-			}
-			h.Debugf("found pre restart hook script: " + strings.Join(matches, " "))
+// negotiateRestart keeps asking the goahead service for a restart until it reaches a terminal state:
+// go ahead, denied, unknown host, error or the configured deadline/maximum number of attempts.
+// The negotiation is persisted in the state_file after each response.
+func negotiateRestart(ctx context.Context, restartReasons []goahead.RestartReason) (restartOutcome, goahead.Response) {
+	deadline := time.Now().Add(config.RestartRequestDeadline)
+	state := resumeRestartState(restartReasons)
+	for attempt := 1; ; attempt++ {
+		response := askForOSRestart(ctx, state.ServiceURL, state.RequestID, restartReasons)
+		state.recordResponse(response)
+		h.Debugf("Restart request attempt " + strconv.Itoa(attempt) + " with request_id " + state.RequestID + " go_ahead: " + strconv.FormatBool(response.Goahead))
+
+		outcome := restartPending
+		var sleep time.Duration
+		switch {
+		case ctx.Err() != nil:
+			outcome = restartAborted
+		case len(response.Error) > 0:
+			outcome = restartServiceError
+		case response.UnknownHost:
+			outcome = restartUnknownHost
+		case response.Goahead:
+			outcome = restartGranted
+		case len(response.FoundCluster) < 1 || len(response.AskagainIn) == 0:
+			outcome = restartDenied
+		case config.RestartRequestMaxAttempts > 0 && attempt >= config.RestartRequestMaxAttempts:
+			outcome = restartMaxAttemptsReached
+		default:
+			var err error
+			sleep, err = time.ParseDuration(response.AskagainIn)
 			if err != nil {
-				h.Fatalf("Failed to glob pre restart hook script directory with glob path " + globPath + " Error: " + err.Error())
+				response.Error = "Error while trying to parse response.AskagainIn to Duration. Error: " + err.Error()
+				outcome = restartServiceError
+			} else if time.Now().Add(sleep).After(deadline) {
+				outcome = restartDeadlineExceeded
 			}
-			sort.Strings(matches)
-			for _, file := range matches {
-				_ = h.ExecuteCommand(file, 10, config.OsRestartHooksAllowFail)
+		}
+
+		state.Status = outcome.String()
+		if outcome == restartGranted {
+			// remember the uptime right before the restart to detect it during the next run
+			uptime, err := getPayloadUptime()
+			if err != nil {
+				h.Infof("The completed restart can only be detected by the boot ID. " + err.Error())
 			}
+			state.Uptime = uptime
+			state.GrantedAt = time.Now()
+		}
+		saveRestartState(state)
+		if outcome != restartPending {
+			return outcome, response
+		}
+
+		h.Infof("Sleeping for " + response.AskagainIn)
+		select {
+		case <-ctx.Done():
+			state.Status = restartAborted.String()
+			saveRestartState(state)
+			return restartAborted, response
+		case <-time.After(sleep):
 		}
 	}
 }
+
+// findScripts returns all files of the given directory in lexical order
+func findScripts(dir string) ([]string, error) {
+	globPath := filepath.Join(dir, "*")
+	h.Debugf("Glob'ing with path " + globPath)
+	matches, err := filepath.Glob(globPath)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
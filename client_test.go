@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -9,23 +10,78 @@ import (
 	"net/http/httptest"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
 	"syscall"
 	"testing"
 	"time"
 
+	"github.com/xorpaul/goahead_client/goahead"
 	H "github.com/xorpaul/gohelper"
 )
 
 var (
 	defaultUrl = "https://127.0.0.1:8443/"
 	ts         *httptest.Server
+
+	// fakeRestartResponses can be filled by test cases with response files which are
+	// returned by the fake goahead service for /v1/request/restart/os in the given order
+	fakeRestartResponses []string
+	// fakeRestartRequestIDs records the request_id of each request to /v1/request/restart/os
+	fakeRestartRequestIDs []string
+	// fakeReports records the reports sent to /v1/report/restart/done
+	fakeReports []goahead.RestartDoneReport
+	// fakeStatusReports records the reports sent to /v1/report/status
+	fakeStatusReports []goahead.StatusReport
+	// fakeAbortReports records the reports sent to /v1/report/restart/aborted
+	fakeAbortReports []goahead.RestartAbortedReport
+	fakeMutex        sync.Mutex
+
+	testReasons = []goahead.RestartReason{{Source: "test", Reason: "testing"}}
 )
 
 func spinUpFakeGoahead() *httptest.Server {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		var request request
+		if r.URL.Path == "/v1/report/restart/done" {
+			var report goahead.RestartDoneReport
+			if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+				log.Fatal(err)
+			}
+			fakeMutex.Lock()
+			fakeReports = append(fakeReports, report)
+			fakeMutex.Unlock()
+			fmt.Fprint(w, `{"timestamp":"2018-10-17T12:29:47.435460276+02:00","message":"OK"}`)
+			return
+		}
+
+		if r.URL.Path == "/v1/report/restart/aborted" {
+			var report goahead.RestartAbortedReport
+			if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+				log.Fatal(err)
+			}
+			fakeMutex.Lock()
+			fakeAbortReports = append(fakeAbortReports, report)
+			fakeMutex.Unlock()
+			fmt.Fprint(w, `{"timestamp":"2018-10-17T12:29:47.435460276+02:00","message":"OK"}`)
+			return
+		}
+
+		if r.URL.Path == "/v1/report/status" {
+			var report goahead.StatusReport
+			if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+				log.Fatal(err)
+			}
+			fakeMutex.Lock()
+			fakeStatusReports = append(fakeStatusReports, report)
+			fakeMutex.Unlock()
+			fmt.Fprint(w, `{"timestamp":"2018-10-17T12:29:47.435460276+02:00","message":"OK"}`)
+			return
+		}
+
+		var request goahead.Request
 		decoder := json.NewDecoder(r.Body)
 		if err := decoder.Decode(&request); err != nil {
 			H.Fatalf("Error while reading response body: " + err.Error())
@@ -43,10 +99,13 @@ func spinUpFakeGoahead() *httptest.Server {
 		} else if r.URL.Path == "/v1/inquire/restart/" {
 			responseFile = "tests/inquireRestart-false.json"
 		} else if r.URL.Path == "/v1/request/restart/os" {
-			if request.RequestID == "sqEALyco" {
-				responseFile = "tests/goahead-true.json"
-			} else {
-				responseFile = "tests/requestRestart-true.json"
+			responseFile = nextFakeRestartResponse(request.RequestID)
+			if len(responseFile) == 0 {
+				if request.RequestID == "sqEALyco" {
+					responseFile = "tests/goahead-true.json"
+				} else {
+					responseFile = "tests/requestRestart-true.json"
+				}
 			}
 		} else {
 			log.Fatal("Unexpected request URL: " + r.URL.Path)
@@ -70,7 +129,13 @@ func TestMain(m *testing.M) {
 	config.ServiceUrl = ts.URL + "/"
 	config.RestartConditionScript = "./tests/always-true.sh"
 	config.OsRestartHooksDir = "./tests/TestRestartHooks/"
-	_ = setupHttpClient()
+	stateDir, err := os.MkdirTemp("", "goahead_client_state")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(stateDir)
+	config.StateFile = filepath.Join(stateDir, "state.json")
+	client = setupClient()
 	exitCode := m.Run()
 	os.Exit(exitCode)
 }
@@ -81,8 +146,7 @@ func TestRestartConditionScriptFalse(t *testing.T) {
 
 	if os.Getenv("TEST_FOR_CRASH_"+H.FuncName()) == "1" {
 		H.Debug = true
-		doMain()
-		return
+		os.Exit(doMain(context.Background()))
 	}
 
 	cmd := exec.Command(os.Args[0], "-test.run="+H.FuncName()+"$")
@@ -99,13 +163,13 @@ func TestRestartConditionScriptFalse(t *testing.T) {
 	}
 
 	expectedLines := [7]string{
-		"Debug ExecuteCommand(): Executing ./tests/always-false.sh",
+		"Debug executeScript(): Executing ./tests/always-false.sh",
 		"Did not find local reason to restart. Asking if I should restart, because of other reasons.",
 	}
 
 	for _, expectedLine := range expectedLines {
 		if !strings.Contains(string(out), expectedLine) {
-			t.Errorf("Could not find expected line '" + expectedLine + "' in output.")
+			t.Errorf("Could not find expected line '%s' in output.", expectedLine)
 		}
 	}
 
@@ -120,8 +184,7 @@ func TestRestartConditionScriptTrue(t *testing.T) {
 
 	if os.Getenv("TEST_FOR_CRASH_"+H.FuncName()) == "1" {
 		H.Debug = true
-		doMain()
-		return
+		os.Exit(doMain(context.Background()))
 	}
 
 	cmd := exec.Command(os.Args[0], "-test.run="+H.FuncName()+"$")
@@ -138,14 +201,14 @@ func TestRestartConditionScriptTrue(t *testing.T) {
 	}
 
 	expectedLines := []string{
-		"Debug ExecuteCommand(): Executing ./tests/always-true.sh",
+		"Debug executeScript(): Executing ./tests/always-true.sh",
 		"Sleeping for 1s",
-		"Debug ExecuteCommand(): Executing tests/TestRestartHooks/001_pre_restart_trigger01.sh",
+		"Debug executeScript(): Executing tests/TestRestartHooks/001_pre_restart_trigger01.sh",
 	}
 
 	for _, expectedLine := range expectedLines {
 		if !strings.Contains(string(out), expectedLine) {
-			t.Errorf("Could not find expected line '" + expectedLine + "' in output.")
+			t.Errorf("Could not find expected line '%s' in output.", expectedLine)
 		}
 	}
 
@@ -165,8 +228,7 @@ func TestRestartConditionScriptTrueFailing(t *testing.T) {
 
 	if os.Getenv("TEST_FOR_CRASH_"+H.FuncName()) == "1" {
 		H.Debug = true
-		doMain()
-		return
+		os.Exit(doMain(context.Background()))
 	}
 
 	cmd := exec.Command(os.Args[0], "-test.run="+H.FuncName()+"$")
@@ -183,12 +245,12 @@ func TestRestartConditionScriptTrueFailing(t *testing.T) {
 	}
 
 	expectedLines := []string{
-		"Debug ExecuteCommand(): Executing ./tests/always-true.sh",
-		"Debug ExecuteCommand(): Executing tests/TestRestartHooksFailing/001_pre_restart_trigger01.sh",
+		"Debug executeScript(): Executing ./tests/always-true.sh",
+		"Debug executeScript(): Executing tests/TestRestartHooksFailing/001_pre_restart_trigger01.sh",
 	}
 	for _, expectedLine := range expectedLines {
 		if !strings.Contains(string(out), expectedLine) {
-			t.Errorf("Could not find expected line '" + expectedLine + "' in output.")
+			t.Errorf("Could not find expected line '%s' in output.", expectedLine)
 		}
 	}
 
@@ -202,8 +264,7 @@ func TestRestartConditionScriptTrueFailing(t *testing.T) {
 func TestUptimeLow(t *testing.T) {
 	if os.Getenv("TEST_FOR_CRASH_"+H.FuncName()) == "1" {
 		H.Debug = true
-		doMain()
-		return
+		os.Exit(doMain(context.Background()))
 	}
 
 	cmd := exec.Command(os.Args[0], "-test.run="+H.FuncName()+"$")
@@ -215,17 +276,17 @@ func TestUptimeLow(t *testing.T) {
 		exitCode = msg.Sys().(syscall.WaitStatus).ExitStatus()
 	}
 
-	if 1 != exitCode {
-		t.Errorf("terminated with %v, but we expected exit status %v Output: %s", exitCode, 1, string(out))
+	if exitCodeDenied != exitCode {
+		t.Errorf("terminated with %v, but we expected exit status %v Output: %s", exitCode, exitCodeDenied, string(out))
 	}
 
 	expectedLines := []string{
-		"Debug getPayload(): Trying to send payload: {\"fqdn\":\"foobar-server-aa02.domain.tld\",\"uptime\":\"2s\"}",
-		"WARN doRestart(): Configured minimum uptime for cluster: 30m0s was not reached by client's uptime: 2s Exiting...",
+		"Debug getPayload(): Trying to send payload: {\"fqdn\":\"foobar-server-aa02.domain.tld\",\"uptime\":\"2s\",\"restart_reason\":\"\",\"restart_reasons\":[{\"source\":\"always-true.sh\",\"reason\":\"\"}]}",
+		"Restart request was denied: Configured minimum uptime for cluster: 30m0s was not reached by client's uptime: 2s Exiting...",
 	}
 	for _, expectedLine := range expectedLines {
 		if !strings.Contains(string(out), expectedLine) {
-			t.Errorf("Could not find expected line '" + expectedLine + "' in output.")
+			t.Errorf("Could not find expected line '%s' in output.", expectedLine)
 		}
 	}
 
@@ -237,3 +298,255 @@ func TestUptimeLow(t *testing.T) {
 	//fmt.Println(string(out))
 
 }
+
+// nextFakeRestartResponse records the received request_id and returns the next queued response file if any
+func nextFakeRestartResponse(rid string) string {
+	fakeMutex.Lock()
+	defer fakeMutex.Unlock()
+	fakeRestartRequestIDs = append(fakeRestartRequestIDs, rid)
+	if len(fakeRestartResponses) == 0 {
+		return ""
+	}
+	responseFile := fakeRestartResponses[0]
+	fakeRestartResponses = fakeRestartResponses[1:]
+	return responseFile
+}
+
+// queueFakeRestartResponses makes the fake goahead service answer the next restart requests
+// with the given response files and resets the recorded request_ids
+func queueFakeRestartResponses(responseFiles ...string) {
+	fakeMutex.Lock()
+	defer fakeMutex.Unlock()
+	fakeRestartResponses = responseFiles
+	fakeRestartRequestIDs = nil
+}
+
+func TestNegotiateRestart(t *testing.T) {
+	savedConfig := config
+	defer func() { config = savedConfig }()
+
+	tests := []struct {
+		name              string
+		responseFiles     []string
+		deadline          time.Duration
+		maxAttempts       int
+		expectedOutcome   restartOutcome
+		expectedExitCode  int
+		expectedRequestID []string
+	}{
+		{"polling until go ahead", []string{"tests/askAgain-short.json", "tests/askAgain-short.json", "tests/askAgain-short.json", "tests/goahead-true.json"},
+			time.Minute, 0, restartGranted, exitCodeOK, []string{"", "pOllAgai", "pOllAgai", "pOllAgai"}},
+		{"unknown host", []string{"tests/unknown-host.json"},
+			time.Minute, 0, restartUnknownHost, exitCodeUnknownHost, []string{""}},
+		{"service error", []string{"tests/askAgain-short.json", "tests/error.json"},
+			time.Minute, 0, restartServiceError, exitCodeServiceError, []string{"", "pOllAgai"}},
+		{"deadline exceeded", []string{"tests/askAgain-long.json"},
+			time.Second, 0, restartDeadlineExceeded, exitCodeDeadlineExceeded, []string{""}},
+		{"maximum attempts reached", []string{"tests/askAgain-short.json", "tests/askAgain-short.json", "tests/askAgain-short.json"},
+			time.Minute, 2, restartMaxAttemptsReached, exitCodeMaxAttemptsReached, []string{"", "pOllAgai"}},
+	}
+	for _, test := range tests {
+		config.RestartRequestDeadline = test.deadline
+		config.RestartRequestMaxAttempts = test.maxAttempts
+		queueFakeRestartResponses(test.responseFiles...)
+		os.Remove(config.StateFile)
+
+		outcome, _ := negotiateRestart(context.Background(), testReasons)
+		if outcome != test.expectedOutcome {
+			t.Errorf("%s: negotiation ended with outcome %v, but we expected %v", test.name, outcome, test.expectedOutcome)
+		}
+		if outcome.exitCode() != test.expectedExitCode {
+			t.Errorf("%s: outcome has exit code %v, but we expected %v", test.name, outcome.exitCode(), test.expectedExitCode)
+		}
+		fakeMutex.Lock()
+		if !reflect.DeepEqual(fakeRestartRequestIDs, test.expectedRequestID) {
+			t.Errorf("%s: service received request_ids %q, but we expected %q", test.name, fakeRestartRequestIDs, test.expectedRequestID)
+		}
+		fakeMutex.Unlock()
+	}
+	queueFakeRestartResponses()
+}
+
+func TestNegotiateRestartContinuesPendingRequest(t *testing.T) {
+	savedConfig := config
+	defer func() { config = savedConfig }()
+	config.RestartRequestDeadline = time.Second
+	config.RestartRequestMaxAttempts = 0
+	config.StateFile = filepath.Join(t.TempDir(), "state.json")
+
+	// a negotiation without final answer keeps its request_id for the next run
+	queueFakeRestartResponses("tests/askAgain-long.json")
+	if outcome, _ := negotiateRestart(context.Background(), testReasons); outcome != restartDeadlineExceeded {
+		t.Errorf("negotiation ended with outcome %v, but we expected %v", outcome, restartDeadlineExceeded)
+	}
+	state, err := readRestartState(config.StateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.RequestID != "pOllAgai" || state.Status != "deadline_exceeded" || state.RestartReason != "testing" {
+		t.Errorf("persisted state is %+v, but we expected request_id pOllAgai with status deadline_exceeded", state)
+	}
+
+	queueFakeRestartResponses("tests/goahead-true.json")
+	if outcome, _ := negotiateRestart(context.Background(), testReasons); outcome != restartGranted {
+		t.Errorf("negotiation ended with outcome %v, but we expected %v", outcome, restartGranted)
+	}
+	fakeMutex.Lock()
+	if !reflect.DeepEqual(fakeRestartRequestIDs, []string{"pOllAgai"}) {
+		t.Errorf("service received request_ids %q, but we expected the pending request_id", fakeRestartRequestIDs)
+	}
+	fakeMutex.Unlock()
+	state, _ = readRestartState(config.StateFile)
+	if state.Status != "granted" || state.LastResponse == nil || !state.LastResponse.Goahead {
+		t.Errorf("persisted state is %+v, but we expected the granted restart", state)
+	}
+
+	// a granted negotiation is not continued
+	queueFakeRestartResponses("tests/askAgain-long.json")
+	negotiateRestart(context.Background(), testReasons)
+	fakeMutex.Lock()
+	if !reflect.DeepEqual(fakeRestartRequestIDs, []string{""}) {
+		t.Errorf("service received request_ids %q, but we expected a new negotiation", fakeRestartRequestIDs)
+	}
+	fakeMutex.Unlock()
+
+	// aborting the context stops the negotiation while waiting for the next request
+	queueFakeRestartResponses("tests/askAgain-short.json")
+	config.RestartRequestDeadline = time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if outcome, _ := negotiateRestart(ctx, testReasons); outcome != restartAborted {
+		t.Errorf("negotiation ended with outcome %v, but we expected %v", outcome, restartAborted)
+	}
+	queueFakeRestartResponses()
+}
+
+func TestNegotiateRestartSticksToServiceURL(t *testing.T) {
+	savedConfig := config
+	savedClient := client
+	defer func() {
+		config = savedConfig
+		client = savedClient
+	}()
+	ts2 := spinUpFakeGoahead()
+	defer ts2.Close()
+	config.RestartRequestDeadline = time.Second
+	config.RestartRequestMaxAttempts = 0
+	config.RequestRetries = -1
+	config.StateFile = filepath.Join(t.TempDir(), "state.json")
+	config.ServiceUrl = ""
+	config.ServiceUrls = []string{ts2.URL + "/", ts.URL + "/"}
+	client = setupClient()
+
+	queueFakeRestartResponses("tests/askAgain-long.json")
+	negotiateRestart(context.Background(), testReasons)
+	state, _ := readRestartState(config.StateFile)
+	if state.RequestID != "pOllAgai" || state.ServiceURL != ts2.URL+"/" {
+		t.Errorf("persisted state is %+v, but we expected request_id pOllAgai from %s", state, ts2.URL+"/")
+	}
+
+	// the request_id is only known to the server that issued it, so there is no failover
+	ts2.Close()
+	config.ServiceUrls = []string{ts.URL + "/", ts2.URL + "/"}
+	client = setupClient()
+	queueFakeRestartResponses("tests/goahead-true.json")
+	if outcome, _ := negotiateRestart(context.Background(), testReasons); outcome != restartServiceError {
+		t.Errorf("negotiation ended with outcome %v, but we expected %v", outcome, restartServiceError)
+	}
+	fakeMutex.Lock()
+	if len(fakeRestartRequestIDs) != 0 {
+		t.Errorf("service received request_ids %q, but the negotiation should stick to the unreachable server", fakeRestartRequestIDs)
+	}
+	fakeMutex.Unlock()
+	queueFakeRestartResponses()
+}
+
+func TestDryRun(t *testing.T) {
+	preRestartHooksFile := "/var/tmp/goahead_client/restart_was_triggered"
+	H.PurgeDir(preRestartHooksFile, H.FuncName())
+
+	config.RestartConditionScript = "./tests/always-true.sh"
+	config.OsRestartHooksDir = "./tests/TestRestartHooks/"
+
+	if os.Getenv("TEST_FOR_CRASH_"+H.FuncName()) == "1" {
+		H.Debug = true
+		dryRun = true
+		client = setupClient()
+		os.Exit(doMain(context.Background()))
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run="+H.FuncName()+"$")
+	cmd.Env = append(os.Environ(), "TEST_FOR_CRASH_"+H.FuncName()+"=1")
+	out, err := cmd.CombinedOutput()
+
+	exitCode := 0
+	if msg, ok := err.(*exec.ExitError); ok { // there is error code
+		exitCode = msg.Sys().(syscall.WaitStatus).ExitStatus()
+	}
+
+	if exitCodeDryRunGranted != exitCode {
+		t.Errorf("terminated with %v, but we expected exit status %v Output: %s", exitCode, exitCodeDryRunGranted, string(out))
+	}
+
+	expectedLines := []string{
+		"\"dry_run\":true",
+		"Dry run: received go ahead to restart, not executing any restart hooks",
+		"Dry run: would execute pre_restart hook 1/2 tests/TestRestartHooks/001_pre_restart_trigger01.sh with timeout 10s and allow_fail false",
+		"Dry run: would execute pre_restart hook 2/2 tests/TestRestartHooks/999_last_trigger.sh with timeout 10s and allow_fail false",
+	}
+	for _, expectedLine := range expectedLines {
+		if !strings.Contains(string(out), expectedLine) {
+			t.Errorf("Could not find expected line '%s' in output.", expectedLine)
+		}
+	}
+	if strings.Contains(string(out), "Debug executeScript(): Executing tests/TestRestartHooks/") {
+		t.Errorf("restart hooks were executed during a dry run. Output: %s", string(out))
+	}
+
+	if H.FileExists(preRestartHooksFile) {
+		t.Errorf("Resulting file from pre restart trigger should be missing after a dry run, but exists: %s", preRestartHooksFile)
+	}
+}
+
+func TestDryRunExitCodes(t *testing.T) {
+	savedConfig := config
+	defer func() {
+		config = savedConfig
+		dryRun = false
+	}()
+	dryRun = true
+	config.StateFile = filepath.Join(t.TempDir(), "state.json")
+	config.OsRestartHooksDir = "./tests/TestRestartHooks/"
+
+	// a dry run which would be granted can be told apart from a dry run without restart reason
+	queueFakeRestartResponses("tests/goahead-true.json")
+	if exitCode := doRestart(context.Background(), testReasons); exitCode != exitCodeDryRunGranted {
+		t.Errorf("dry run with go ahead returned exit code %d, but we expected %d", exitCode, exitCodeDryRunGranted)
+	}
+	queueFakeRestartResponses()
+
+	config.RestartConditionScript = "./tests/always-false.sh"
+	if exitCode := doMain(context.Background()); exitCode != exitCodeOK {
+		t.Errorf("dry run without restart reason returned exit code %d, but we expected %d", exitCode, exitCodeOK)
+	}
+}
+
+func TestDryRunDenied(t *testing.T) {
+	savedConfig := config
+	defer func() {
+		config = savedConfig
+		dryRun = false
+	}()
+	dryRun = true
+	config.StateFile = filepath.Join(t.TempDir(), "state.json")
+
+	// the exit code reflects the answer of the service and no state is persisted
+	queueFakeRestartResponses("tests/unknown-host.json")
+	if exitCode := doRestart(context.Background(), testReasons); exitCode != exitCodeUnknownHost {
+		t.Errorf("dry run returned exit code %d, but we expected %d", exitCode, exitCodeUnknownHost)
+	}
+	if H.FileExists(config.StateFile) {
+		t.Errorf("dry run should not write the state file %s", config.StateFile)
+	}
+	queueFakeRestartResponses()
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xorpaul/goahead_client/goahead"
+	h "github.com/xorpaul/gohelper"
+)
+
+// commandOptions are the settings shared by all subcommands, which can be given before or after the
+// name of the subcommand
+type commandOptions struct {
+	configFile   string
+	disabledFile string
+}
+
+// command is a subcommand of the goahead client
+type command struct {
+	name        string
+	usage       string
+	description string
+	run         func(args []string, options *commandOptions) int
+}
+
+// commands are the subcommands in the order of the usage text
+var commands []command
+
+func init() {
+	commands = []command{
+		{"check", "check", "Runs the restart condition detectors and scripts and prints the found restart reasons.\n" +
+			"Exit codes: 0 no restart needed, 10 restart needed, 9 a restart condition script failed", runCheckCommand},
+		{"inquire", "inquire", "Asks the goahead service if this host should restart because of reasons only the service knows.\n" +
+			"Exit codes: 0 no restart needed, 10 restart suggested by the service, 5 service error", runInquireCommand},
+		{"request", "request [-reason text]", "Negotiates the restart with the goahead service, but does not execute the restart hooks.\n" +
+			"Without -reason the restart reasons of check are sent.\n" +
+			"Exit codes: 0 go ahead received or host disabled, 3-8, 11 and 12 see the exit codes of a normal run", runRequestCommand},
+		{"hooks", "hooks list|run", "Lists or executes the restart hooks of os_restart_hooks_dir in their order and the restart_action.\n" +
+			"If a pre_restart or restart hook fails, the on_abort hooks are executed.\n" +
+			"Exit codes: 0 success, 1 a restart hook failed or has invalid settings", runHooksCommand},
+		{"status", "status [-json]", "Shows the persisted restart state and if the goahead client is disabled.\n" +
+			"Exit codes: 0 success, 1 the state file could not be read", runStatusCommand},
+		{"disable", "disable -reason text [-until time|-for duration]", "Disables the goahead client administratively, optionally until the given time.\n" +
+			"Exit codes: 0 success, 1 the disabled file could not be written", runDisableCommand},
+		{"enable", "enable", "Enables the goahead client again by removing the disabled file.\n" +
+			"Exit codes: 0 success, 1 the disabled file could not be removed", runEnableCommand},
+		{"config", "config validate", "Validates the config file and the TLS settings.\n" +
+			"Exit codes: 0 valid config, 1 invalid config", runConfigCommand},
+		{"version", "version", "Shows build time and version number.", runVersionCommand},
+		{"help", "help [command]", "Shows the usage of the goahead client or of a command.", runHelpCommand},
+	}
+}
+
+// printUsage prints the usage of the goahead client with all subcommands
+func printUsage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "Usage: goahead_client [flags] [command]")
+	fmt.Fprintln(out, "")
+	fmt.Fprintln(out, "Without command the restart condition is checked, the restart negotiated and the restart hooks executed.")
+	fmt.Fprintln(out, "")
+	fmt.Fprintln(out, "Commands:")
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %-24s %s\n", c.usage, strings.SplitN(c.description, "\n", 2)[0])
+	}
+	fmt.Fprintln(out, "")
+	fmt.Fprintln(out, "Flags:")
+	flag.PrintDefaults()
+}
+
+// runCommand executes the subcommand given as first argument and returns its exit code
+func runCommand(args []string, options *commandOptions) int {
+	for _, c := range commands {
+		if c.name == args[0] {
+			return c.run(args[1:], options)
+		}
+	}
+	fmt.Fprintln(os.Stderr, "Unknown command "+args[0])
+	printUsage()
+	return 2
+}
+
+// parseCommandFlags parses the flags of the subcommand, which include the shared flags, and returns
+// the remaining arguments. Flags are also accepted after the arguments, e.g. hooks list -debug. ok is
+// false if the command should exit with the returned exit code.
+func parseCommandFlags(fs *flag.FlagSet, args []string, options *commandOptions) (arguments []string, exitCode int, ok bool) {
+	fs.StringVar(&options.configFile, "config", options.configFile, "which config file to use")
+	fs.StringVar(&options.disabledFile, "disabled", options.disabledFile, "file to check if goahead run should be skipped")
+	fs.BoolVar(&debug, "debug", debug, "log debug output, defaults to false")
+	for {
+		if err := fs.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return nil, exitCodeOK, false
+			}
+			return nil, 2, false
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		arguments = append(arguments, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	h.Debug = debug
+	return arguments, exitCodeOK, true
+}
+
+// commandFlags are the values of the flags, which only some subcommands have
+type commandFlags struct {
+	reason   string
+	until    string
+	duration time.Duration
+	by       string
+	json     bool
+}
+
+// newCommandFlagSet creates the flag set of the subcommand with its own flags and usage text, it is
+// used to run the subcommand and to print its help
+func newCommandFlagSet(name string) (*flag.FlagSet, *commandFlags) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	values := &commandFlags{}
+	switch name {
+	case "request":
+		fs.StringVar(&values.reason, "reason", "", "restart reason to send instead of the found restart reasons")
+	case "status":
+		fs.BoolVar(&values.json, "json", false, "print the state file as JSON")
+	case "disable":
+		fs.StringVar(&values.reason, "reason", "", "why the goahead client is disabled, required")
+		fs.StringVar(&values.until, "until", "", "enable the goahead client again after this time, e.g. 2026-11-01T00:00Z")
+		fs.DurationVar(&values.duration, "for", 0, "enable the goahead client again after this duration, e.g. 72h")
+		fs.StringVar(&values.by, "by", currentOperator(), "who disabled the goahead client")
+	}
+	fs.Usage = func() {
+		for _, c := range commands {
+			if c.name == name {
+				fmt.Fprintln(fs.Output(), "Usage: goahead_client "+c.usage)
+				fmt.Fprintln(fs.Output(), "")
+				fmt.Fprintln(fs.Output(), c.description)
+			}
+		}
+		fmt.Fprintln(fs.Output(), "")
+		fmt.Fprintln(fs.Output(), "Flags:")
+		fs.PrintDefaults()
+	}
+	return fs, values
+}
+
+func runCheckCommand(args []string, options *commandOptions) int {
+	fs, _ := newCommandFlagSet("check")
+	if _, exitCode, ok := parseCommandFlags(fs, args, options); !ok {
+		return exitCode
+	}
+	loadConfig(options.configFile)
+
+	reasons, failed := collectRestartReasons(context.Background())
+	for _, reason := range reasons {
+		fmt.Println(reason.Source + ": " + reason.Reason)
+	}
+	if len(reasons) > 0 {
+		fmt.Println("Restart needed")
+		return exitCodeRestartNeeded
+	} else if failed {
+		fmt.Println("Could not determine if a restart is needed, because restart condition scripts failed")
+		return exitCodeConditionError
+	}
+	fmt.Println("No restart needed")
+	return exitCodeOK
+}
+
+func runInquireCommand(args []string, options *commandOptions) int {
+	fs, _ := newCommandFlagSet("inquire")
+	if _, exitCode, ok := parseCommandFlags(fs, args, options); !ok {
+		return exitCode
+	}
+	loadConfig(options.configFile)
+
+	response, err := client.Inquire(context.Background())
+	if err != nil {
+		fmt.Println(err.Error())
+		return exitCodeServiceError
+	}
+	fmt.Println(response.Message)
+	if strings.HasPrefix(response.Message, "YesInquireToRestart") {
+		return exitCodeRestartNeeded
+	}
+	return exitCodeOK
+}
+
+func runRequestCommand(args []string, options *commandOptions) int {
+	fs, values := newCommandFlagSet("request")
+	if _, exitCode, ok := parseCommandFlags(fs, args, options); !ok {
+		return exitCode
+	}
+	loadConfig(options.configFile)
+	if isDisabled(options.disabledFile) {
+		return exitCodeOK
+	}
+	if b, active := activeBlackout(now()); active {
+		fmt.Println("Not asking for a restart during blackout " + b.String())
+		return exitCodeBlackout
+	}
+	if open, next := maintenanceWindowOpen(now()); !open {
+		fmt.Println("Not asking for a restart outside of the maintenance windows, " + formatNextMaintenanceWindow(next))
+		return exitCodeOutsideMaintenanceWindow
+	}
+
+	var reasons []goahead.RestartReason
+	if len(values.reason) > 0 {
+		reasons = []goahead.RestartReason{{Source: "command line", Reason: values.reason}}
+	} else {
+		reasons, _ = collectRestartReasons(context.Background())
+		if len(reasons) == 0 {
+			reasons = []goahead.RestartReason{{Source: "command line", Reason: "requested via command line"}}
+		}
+	}
+	outcome, response := negotiateRestart(context.Background(), reasons)
+	fmt.Println("Restart request with request_id " + response.RequestID + " ended with " + outcome.String() + ": " + response.Message + response.Error)
+	return outcome.exitCode()
+}
+
+func runHooksCommand(args []string, options *commandOptions) int {
+	fs, _ := newCommandFlagSet("hooks")
+	arguments, exitCode, ok := parseCommandFlags(fs, args, options)
+	if !ok {
+		return exitCode
+	}
+	if len(arguments) != 1 || (arguments[0] != "list" && arguments[0] != "run") {
+		fs.Usage()
+		return 2
+	}
+	loadConfig(options.configFile)
+
+	if arguments[0] == "list" {
+		for _, phase := range hookPhases {
+			plan, invalidHook, err := planPhase(phase)
+			if err != nil {
+				fmt.Println(string(phase) + " " + invalidHook + " invalid settings: " + err.Error())
+				exitCode = 1
+				continue
+			}
+			for i, hook := range plan {
+				fmt.Println(string(phase) + " " + strconv.Itoa(i+1) + " " + hook.file + " " + hook.settings.String() + hook.waitsFor(plan))
+			}
+			if phase == phaseRestart && len(config.RestartAction.Type) > 0 {
+				fmt.Println(string(phaseRestartAction) + " " + config.RestartAction.Type + " delay " + config.RestartAction.Delay.String() + " timeout " + config.RestartAction.Timeout.String())
+			}
+		}
+		return exitCode
+	}
+	// without a negotiated restart the goahead service is not told about an abort
+	return executeRestartHooks(context.Background(), goahead.Response{})
+}
+
+func runStatusCommand(args []string, options *commandOptions) int {
+	fs, values := newCommandFlagSet("status")
+	if _, exitCode, ok := parseCommandFlags(fs, args, options); !ok {
+		return exitCode
+	}
+	loadConfig(options.configFile)
+
+	state, err := readRestartState(config.StateFile)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	disable, disabled := readDisabledState(options.disabledFile)
+
+	windowOpen, nextWindow := maintenanceWindowOpen(time.Now())
+	activeFreeze, frozen := activeBlackout(time.Now())
+
+	if values.json {
+		type maintenanceWindowStatus struct {
+			Open      bool      `json:"open"`
+			NextStart time.Time `json:"next_start,omitzero"`
+		}
+		status := struct {
+			Disabled          bool                     `json:"disabled"`
+			Disable           *disabledState           `json:"disable,omitempty"`
+			MaintenanceWindow *maintenanceWindowStatus `json:"maintenance_window,omitempty"`
+			Blackout          string                   `json:"blackout,omitempty"`
+			State             restartState             `json:"state"`
+		}{Disabled: disabled, State: state}
+		if frozen {
+			status.Blackout = activeFreeze.String()
+		}
+		if disabled {
+			status.Disable = &disable
+		}
+		if len(config.MaintenanceWindows) > 0 {
+			status.MaintenanceWindow = &maintenanceWindowStatus{windowOpen, nextWindow}
+		}
+		data, err := json.MarshalIndent(status, "", "  ")
+		if err != nil {
+			fmt.Println("Failed to encode status: " + err.Error())
+			return 1
+		}
+		fmt.Println(string(data))
+		return exitCodeOK
+	}
+
+	if disabled {
+		fmt.Println("Disabled:       yes (" + disable.String() + ")")
+	} else {
+		fmt.Println("Disabled:       no")
+	}
+	if len(config.MaintenanceWindows) > 0 {
+		if windowOpen {
+			fmt.Println("Maintenance:    window open")
+		} else {
+			fmt.Println("Maintenance:    outside of the maintenance windows, " + formatNextMaintenanceWindow(nextWindow))
+		}
+	}
+	if frozen {
+		fmt.Println("Blackout:       " + activeFreeze.String())
+	}
+	fmt.Println("State file:     " + config.StateFile)
+	if len(state.Status) == 0 {
+		fmt.Println("Status:         no restart requested yet")
+		return exitCodeOK
+	}
+	fmt.Println("Status:         " + state.Status)
+	fmt.Println("Request ID:     " + state.RequestID)
+	fmt.Println("Service URL:    " + state.ServiceURL)
+	fmt.Println("Restart reason: " + sanitizeReason(state.RestartReason, 0))
+	fmt.Println("Requested at:   " + formatStatusTime(state.RequestedAt))
+	fmt.Println("Updated at:     " + formatStatusTime(state.UpdatedAt))
+	fmt.Println("Granted at:     " + formatStatusTime(state.GrantedAt))
+	fmt.Println("Reported at:    " + formatStatusTime(state.ReportedAt))
+	if state.LastResponse != nil {
+		fmt.Println("Last message:   " + state.LastResponse.Message + state.LastResponse.Error)
+	}
+	return exitCodeOK
+}
+
+func runDisableCommand(args []string, options *commandOptions) int {
+	fs, values := newCommandFlagSet("disable")
+	if _, exitCode, ok := parseCommandFlags(fs, args, options); !ok {
+		return exitCode
+	}
+	if len(strings.TrimSpace(values.reason)) == 0 {
+		fmt.Fprintln(os.Stderr, "Missing -reason, please tell your colleagues why the goahead client is disabled")
+		return 2
+	}
+	if len(values.until) > 0 && values.duration != 0 {
+		fmt.Fprintln(os.Stderr, "Only one of -until and -for can be used")
+		return 2
+	}
+
+	state := disabledState{Reason: strings.TrimSpace(values.reason), DisabledBy: values.by, DisabledAt: time.Now()}
+	if len(values.until) > 0 {
+		t, err := parseTimestamp(values.until)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 2
+		}
+		state.Until = t
+	} else if values.duration != 0 {
+		state.Until = state.DisabledAt.Add(values.duration)
+	}
+	if !state.Until.IsZero() && !state.Until.After(state.DisabledAt) {
+		fmt.Fprintln(os.Stderr, "The expiry "+state.Until.Format(time.RFC3339)+" is not in the future")
+		return 2
+	}
+
+	if err := writeDisabledState(options.disabledFile, state); err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	fmt.Println("Disabled goahead client (" + state.String() + ")")
+	return exitCodeOK
+}
+
+func runEnableCommand(args []string, options *commandOptions) int {
+	fs, _ := newCommandFlagSet("enable")
+	if _, exitCode, ok := parseCommandFlags(fs, args, options); !ok {
+		return exitCode
+	}
+	disable, disabled := readDisabledState(options.disabledFile)
+	if !disabled {
+		fmt.Println("goahead client is not disabled")
+		return exitCodeOK
+	}
+	if err := os.Remove(options.disabledFile); err != nil {
+		fmt.Println("Failed to remove disabled file " + options.disabledFile + " Error: " + err.Error())
+		return 1
+	}
+	fmt.Println("Enabled goahead client, which was disabled (" + disable.String() + ")")
+	return exitCodeOK
+}
+
+func formatStatusTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func runConfigCommand(args []string, options *commandOptions) int {
+	fs, _ := newCommandFlagSet("config")
+	arguments, exitCode, ok := parseCommandFlags(fs, args, options)
+	if !ok {
+		return exitCode
+	}
+	if len(arguments) != 1 || arguments[0] != "validate" {
+		fs.Usage()
+		return 2
+	}
+
+	validatedConfig, err := loadConfigfile(options.configFile)
+	if err == nil {
+		_, err = newClient(validatedConfig)
+	}
+	if err != nil {
+		fmt.Println("Config file " + options.configFile + " is invalid: " + err.Error())
+		return 1
+	}
+	fmt.Println("Config file " + options.configFile + " is valid")
+	return exitCodeOK
+}
+
+func runVersionCommand(args []string, options *commandOptions) int {
+	fs, _ := newCommandFlagSet("version")
+	if _, exitCode, ok := parseCommandFlags(fs, args, options); !ok {
+		return exitCode
+	}
+	printVersion()
+	return exitCodeOK
+}
+
+func runHelpCommand(args []string, options *commandOptions) int {
+	if len(args) == 0 {
+		flag.CommandLine.SetOutput(os.Stdout)
+		printUsage()
+		return exitCodeOK
+	}
+	for _, c := range commands {
+		if c.name == args[0] && c.name != "help" {
+			fs, _ := newCommandFlagSet(c.name)
+			fs.SetOutput(os.Stdout)
+			parseCommandFlags(fs, []string{"-h"}, options)
+			return exitCodeOK
+		}
+	}
+	fmt.Fprintln(os.Stderr, "Unknown command "+args[0])
+	return 2
+}
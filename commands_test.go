@@ -0,0 +1,115 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRunCommand(t *testing.T) {
+	savedConfig := config
+	savedClient := client
+	defer func() {
+		config = savedConfig
+		client = savedClient
+	}()
+
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "client.yml")
+	configContent := "---\n" +
+		"service_url: " + ts.URL + "/\n" +
+		"restart_condition_script: ./tests/always-true.sh\n" +
+		"os_restart_hooks_dir: ./tests/TestRestartHooks/\n" +
+		"state_file: " + filepath.Join(dir, "state.json") + "\n"
+	if err := os.WriteFile(configFile, []byte(configContent), 0644); err != nil {
+		t.Fatal(err)
+	}
+	invalidConfigFile := filepath.Join(dir, "invalid.yml")
+	if err := os.WriteFile(invalidConfigFile, []byte("---\nservice_url: "+ts.URL+"/\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		args             []string
+		expectedExitCode int
+	}{
+		{[]string{"check"}, exitCodeRestartNeeded},
+		{[]string{"inquire"}, exitCodeOK},
+		{[]string{"request", "-reason", "kernel update"}, exitCodeOK},
+		{[]string{"status", "-json"}, exitCodeOK},
+		{[]string{"status"}, exitCodeOK},
+		{[]string{"hooks", "list"}, exitCodeOK},
+		{[]string{"hooks", "reboot"}, 2},
+		{[]string{"config", "validate"}, exitCodeOK},
+		{[]string{"config", "validate", "-config", invalidConfigFile}, 1},
+		{[]string{"version"}, exitCodeOK},
+		{[]string{"check", "-h"}, exitCodeOK},
+		{[]string{"check", "-unknown"}, 2},
+		{[]string{"help", "disable"}, exitCodeOK},
+		{[]string{"unknown"}, 2},
+	}
+	for _, test := range tests {
+		options := &commandOptions{configFile: configFile, disabledFile: filepath.Join(dir, "disabled")}
+		if exitCode := runCommand(test.args, options); exitCode != test.expectedExitCode {
+			t.Errorf("command %q returned exit code %d, but we expected %d", test.args, exitCode, test.expectedExitCode)
+		}
+	}
+
+	// the request command does not ask for a restart outside of the maintenance windows
+	closedConfigFile := filepath.Join(dir, "closed.yml")
+	closedConfig := configContent + "maintenance_windows:\n  - days: [mon]\n    start: \"02:00\"\n    end: \"04:00\"\n    time_zone: UTC\n"
+	if err := os.WriteFile(closedConfigFile, []byte(closedConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fakeNow(t, time.Date(2026, 10, 19, 5, 0, 0, 0, time.UTC))
+	queueFakeRestartResponses()
+	options := &commandOptions{configFile: closedConfigFile, disabledFile: filepath.Join(dir, "disabled")}
+	if exitCode := runCommand([]string{"request", "-reason", "kernel update"}, options); exitCode != exitCodeOutsideMaintenanceWindow {
+		t.Errorf("command request returned exit code %d outside of the maintenance window, but we expected %d", exitCode, exitCodeOutsideMaintenanceWindow)
+	}
+	fakeMutex.Lock()
+	if len(fakeRestartRequestIDs) != 0 {
+		t.Errorf("service received %d restart requests outside of the maintenance window", len(fakeRestartRequestIDs))
+	}
+	fakeMutex.Unlock()
+
+	// nor during a blackout
+	frozenConfigFile := filepath.Join(dir, "frozen.yml")
+	frozenConfig := configContent + "blackouts:\n  - start: 2026-10-19T00:00:00Z\n    end: 2026-10-20T00:00:00Z\n    reason: product launch\n"
+	if err := os.WriteFile(frozenConfigFile, []byte(frozenConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	options = &commandOptions{configFile: frozenConfigFile, disabledFile: filepath.Join(dir, "disabled")}
+	if exitCode := runCommand([]string{"request", "-reason", "kernel update"}, options); exitCode != exitCodeBlackout {
+		t.Errorf("command request returned exit code %d during a blackout, but we expected %d", exitCode, exitCodeBlackout)
+	}
+	fakeMutex.Lock()
+	if len(fakeRestartRequestIDs) != 0 {
+		t.Errorf("service received %d restart requests during a blackout", len(fakeRestartRequestIDs))
+	}
+	fakeMutex.Unlock()
+
+	// the request command persists the granted restart
+	state, err := readRestartState(filepath.Join(dir, "state.json"))
+	if err != nil || state.Status != "granted" || state.RestartReason != "kernel update" {
+		t.Errorf("persisted state is %+v with error %v, but we expected the granted restart", state, err)
+	}
+}
+
+func TestCommandFlagSet(t *testing.T) {
+	// the help of a command is printed with the same flag set which is used to run it
+	expectedFlags := map[string][]string{
+		"request": {"reason"},
+		"status":  {"json"},
+		"disable": {"reason", "until", "for", "by"},
+	}
+	for name, flags := range expectedFlags {
+		fs, _ := newCommandFlagSet(name)
+		for _, f := range flags {
+			if fs.Lookup(f) == nil {
+				t.Errorf("flag set of command %s is missing the flag -%s", name, f)
+			}
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	shellquote "github.com/kballard/go-shellquote"
+	"github.com/xorpaul/goahead_client/goahead"
+	h "github.com/xorpaul/gohelper"
+)
+
+// conditionVote is the answer of a restart condition script
+type conditionVote int
+
+const (
+	voteNotNeeded conditionVote = iota
+	voteNeeded
+	voteError
+)
+
+func (v conditionVote) String() string {
+	switch v {
+	case voteNeeded:
+		return "needed"
+	case voteError:
+		return "error"
+	}
+	return "not needed"
+}
+
+// conditionResult is the vote of a single script of restart_condition_scripts_dir
+type conditionResult struct {
+	Script string
+	Vote   conditionVote
+	Output string
+}
+
+// runRestartConditionScripts executes all scripts of restart_condition_scripts_dir, up to
+// restart_condition_scripts_concurrency at the same time, and returns their votes in lexical order
+// of the scripts. A script votes for a restart with restart_condition_scripts_exit_code_for_reboot,
+// against it with restart_condition_scripts_exit_code_for_no_reboot and any other exit code, a
+// timeout or a script which could not be executed is an error.
+func runRestartConditionScripts(ctx context.Context) []conditionResult {
+	if len(config.RestartConditionScriptsDir) == 0 {
+		return nil
+	}
+	scripts, err := findScripts(config.RestartConditionScriptsDir)
+	if err != nil {
+		// the restart condition can not be determined without the scripts
+		return []conditionResult{{Script: config.RestartConditionScriptsDir, Vote: voteError, Output: "Failed to glob restart condition script directory Error: " + err.Error()}}
+	}
+	if len(scripts) == 0 {
+		h.Infof("Could not find any restart condition scripts in " + config.RestartConditionScriptsDir)
+		return nil
+	}
+
+	results := make([]conditionResult, len(scripts))
+	semaphore := make(chan struct{}, config.RestartConditionScriptsConcurrency)
+	var wg sync.WaitGroup
+	for i, script := range scripts {
+		wg.Add(1)
+		go func(i int, script string) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			sr := runScript(ctx, script, config.RestartConditionScriptsTimeout)
+			result := conditionResult{Script: filepath.Base(script), Output: strings.TrimSpace(sr.Output)}
+			switch {
+			case sr.Err != nil:
+				result.Vote = voteError
+				result.Output = strings.TrimSpace(sr.Err.Error() + " " + result.Output)
+			case sr.ReturnCode == config.RestartConditionScriptsExitCodeForReboot:
+				result.Vote = voteNeeded
+			case sr.ReturnCode == config.RestartConditionScriptsExitCodeForNoReboot:
+				result.Vote = voteNotNeeded
+			default:
+				result.Vote = voteError
+				result.Output = strings.TrimSpace("unexpected exit code " + strconv.Itoa(sr.ReturnCode) + " " + result.Output)
+			}
+			h.Debugf("Restart condition script " + script + " voted " + result.Vote.String())
+			results[i] = result
+		}(i, script)
+	}
+	wg.Wait()
+	return results
+}
+
+// collectRestartReasons runs all configured detectors and restart condition scripts and returns the
+// found restart reasons. failed is true if a restart condition script failed.
+func collectRestartReasons(ctx context.Context) (reasons []goahead.RestartReason, failed bool) {
+	reasons = runRestartConditionDetectors()
+
+	if len(config.RestartConditionScript) > 0 {
+		// the restart_condition_script may contain arguments after the script
+		script, arguments, _ := strings.Cut(config.RestartConditionScript, " ")
+		if args, err := shellquote.Split(arguments); err != nil {
+			h.Infof("Failed to parse the arguments of restart_condition_script " + config.RestartConditionScript + " Error: " + err.Error())
+			failed = true
+		} else if result := runArgs(ctx, config.RestartConditionScriptTimeout, script, args...); result.Err != nil {
+			h.Infof("Restart condition script " + config.RestartConditionScript + " failed: " + result.Err.Error() + " " + result.Output)
+			failed = true
+		} else if result.ReturnCode == config.RestartConditionScriptExitCodeForReboot {
+			reasons = append(reasons, parseRestartReason(filepath.Base(script), result.Output))
+		}
+	}
+
+	for _, result := range runRestartConditionScripts(ctx) {
+		switch result.Vote {
+		case voteNeeded:
+			reason := parseRestartReason(result.Script, result.Output)
+			h.Infof("Restart condition script " + result.Script + " found reason to restart: " + reason.Reason)
+			reasons = append(reasons, reason)
+		case voteError:
+			h.Infof("Restart condition script " + result.Script + " failed: " + result.Output)
+			failed = true
+		}
+	}
+	return reasons, failed
+}
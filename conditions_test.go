@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xorpaul/goahead_client/goahead"
+)
+
+func TestRunRestartConditionScripts(t *testing.T) {
+	savedConfig := config
+	defer func() { config = savedConfig }()
+	config.RestartConditionScriptsDir = "./tests/TestRestartConditionScripts/"
+	config.RestartConditionScriptsConcurrency = 2
+	config.RestartConditionScriptsTimeout = 500 * time.Millisecond
+	config.RestartConditionScriptsExitCodeForReboot = 1
+	config.RestartConditionScriptsExitCodeForNoReboot = 0
+
+	results := runRestartConditionScripts(context.Background())
+	expected := []conditionResult{
+		{"010_reboot_needed.sh", voteNeeded, "libssl3 was updated"},
+		{"015_reboot_needed_json.sh", voteNeeded, `{"type":"library","severity":"high","reason":"openssl was updated","packages":["libssl3","openssl"],"cves":["CVE-2023-0286"]}`},
+		{"020_no_reboot_needed.sh", voteNotNeeded, "kernel is up to date"},
+		{"030_broken.sh", voteError, "unexpected exit code 2 could not query package manager"},
+		{"040_hanging.sh", voteError, "killed after timeout of 500ms"},
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("restart condition scripts voted %+v, but we expected %+v", results, expected)
+	}
+
+	config.RestartConditionScript = ""
+	config.RestartConditionDetectors = nil
+	reasons, failed := collectRestartReasons(context.Background())
+	expectedReasons := []goahead.RestartReason{
+		{Source: "010_reboot_needed.sh", Reason: "libssl3 was updated"},
+		{Source: "015_reboot_needed_json.sh", Type: "library", Severity: "high", Reason: "openssl was updated", Packages: []string{"libssl3", "openssl"}, CVEs: []string{"CVE-2023-0286"}},
+	}
+	if !failed || !reflect.DeepEqual(reasons, expectedReasons) {
+		t.Errorf("collected reasons %+v and failed %v, but we expected %+v and a failure", reasons, failed, expectedReasons)
+	}
+}
+
+func TestRestartConditionScriptsFailing(t *testing.T) {
+	savedConfig := config
+	defer func() { config = savedConfig }()
+	config.RestartConditionScript = ""
+	config.RestartConditionScriptsDir = "./tests/TestRestartConditionScriptsFailing/"
+	config.RestartConditionScriptsConcurrency = 4
+	config.RestartConditionScriptsExitCodeForReboot = 1
+	config.RestartConditionScriptsExitCodeForNoReboot = 0
+
+	// a failed restart condition script neither requests nor inquires a restart
+	if exitCode := doMain(context.Background()); exitCode != exitCodeConditionError {
+		t.Errorf("doMain returned exit code %d, but we expected %d", exitCode, exitCodeConditionError)
+	}
+}
+
+func TestRunScript(t *testing.T) {
+	result := runScript(context.Background(), "./tests/TestRestartConditionScripts/030_broken.sh", time.Second)
+	if result.ReturnCode != 2 || result.Err != nil || strings.TrimSpace(result.Output) != "could not query package manager" {
+		t.Errorf("unexpected result %+v", result)
+	}
+	result = runScript(context.Background(), "./tests/non-existent.sh", time.Second)
+	if result.ReturnCode != -1 || result.Err == nil {
+		t.Errorf("a missing script should return an error, got %+v", result)
+	}
+}
+
+func TestParseRestartReason(t *testing.T) {
+	savedConfig := config
+	defer func() { config = savedConfig }()
+	config.RestartReasonMaxLength = 32
+
+	tests := []struct {
+		output   string
+		expected goahead.RestartReason
+	}{
+		{"kernel update\n", goahead.RestartReason{Source: "script", Reason: "kernel update"}},
+		{"\x1b[31mkernel\r\n\tupdate\x00 pending\xff", goahead.RestartReason{Source: "script", Reason: "[31mkernel update pending"}},
+		{"the restart reason is longer than allowed", goahead.RestartReason{Source: "script", Reason: "the restart reason is longer ..."}},
+		{`{"source":"needrestart","type":"kernel","reason":"new kernel\ninstalled"}`, goahead.RestartReason{Source: "needrestart", Type: "kernel", Reason: "new kernel installed"}},
+		{`{"reason":"broken json"`, goahead.RestartReason{Source: "script", Reason: `{"reason":"broken json"`}},
+	}
+	for _, test := range tests {
+		if got := parseRestartReason("script", test.output); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("parseRestartReason(%q) returned %+v, but we expected %+v", test.output, got, test.expected)
+		}
+	}
+}
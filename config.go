@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
 	"io/ioutil"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -12,34 +14,131 @@ import (
 
 // configSettings contains the key value pairs from the config file
 type configSettings struct {
-	Timeout                                 time.Duration `yaml:"timeout"`
-	ServiceUrl                              string        `yaml:"service_url"`
-	ServiceUrlCaFile                        string        `yaml:"service_url_ca_file"`
-	Fqdn                                    string        `yaml:"requesting_fqdn"`
-	PrivateKey                              string        `yaml:"ssl_private_key,omitempty"`
-	CertificateFile                         string        `yaml:"ssl_certificate_file,omitempty"`
-	RequireAndVerifyClientCert              bool          `yaml:"ssl_require_and_verify_client_cert"`
-	RestartConditionScript                  string        `yaml:"restart_condition_script"`
-	RestartConditionScriptExitCodeForReboot int           `yaml:"restart_condition_script_exit_code_for_reboot"`
-	OsRestartHooksDir                       string        `yaml:"os_restart_hooks_dir"`
-	OsRestartHooksAllowFail                 bool          `yaml:"os_restart_hooks_allow_fail"`
+	Timeout                                    time.Duration         `yaml:"timeout"`
+	ServiceUrl                                 string                `yaml:"service_url"`
+	ServiceUrls                                []string              `yaml:"service_urls"`
+	ServiceUrlSelection                        string                `yaml:"service_url_selection"`
+	ServiceSrv                                 string                `yaml:"service_srv"`
+	ServiceSrvScheme                           string                `yaml:"service_srv_scheme"`
+	ServiceSrvResolver                         string                `yaml:"service_srv_resolver"`
+	ServiceUrlCaFile                           string                `yaml:"service_url_ca_file"`
+	Fqdn                                       string                `yaml:"requesting_fqdn"`
+	PrivateKey                                 string                `yaml:"ssl_private_key,omitempty"`
+	CertificateFile                            string                `yaml:"ssl_certificate_file,omitempty"`
+	PrivateKeyPassphrase                       string                `yaml:"ssl_private_key_passphrase,omitempty"`
+	RequireAndVerifyClientCert                 bool                  `yaml:"ssl_require_and_verify_client_cert"`
+	RestartConditionScript                     string                `yaml:"restart_condition_script"`
+	RestartConditionScriptExitCodeForReboot    int                   `yaml:"restart_condition_script_exit_code_for_reboot"`
+	RestartConditionScriptTimeout              time.Duration         `yaml:"restart_condition_script_timeout"`
+	RestartConditionDetectors                  []string              `yaml:"restart_condition_detectors"`
+	RestartReasonMaxLength                     int                   `yaml:"restart_reason_max_length"`
+	RestartConditionScriptsDir                 string                `yaml:"restart_condition_scripts_dir"`
+	RestartConditionScriptsConcurrency         int                   `yaml:"restart_condition_scripts_concurrency"`
+	RestartConditionScriptsTimeout             time.Duration         `yaml:"restart_condition_scripts_timeout"`
+	RestartConditionScriptsExitCodeForReboot   int                   `yaml:"restart_condition_scripts_exit_code_for_reboot"`
+	RestartConditionScriptsExitCodeForNoReboot int                   `yaml:"restart_condition_scripts_exit_code_for_no_reboot"`
+	OsRestartHooksDir                          string                `yaml:"os_restart_hooks_dir"`
+	OsRestartHooksAllowFail                    bool                  `yaml:"os_restart_hooks_allow_fail"`
+	OsRestartHooksTimeout                      time.Duration         `yaml:"os_restart_hooks_timeout"`
+	OsRestartHooksParallel                     bool                  `yaml:"os_restart_hooks_parallel"`
+	OsPostRestartChecksDir                     string                `yaml:"os_post_restart_checks_dir"`
+	OsPostRestartChecksDeadline                time.Duration         `yaml:"os_post_restart_checks_deadline"`
+	OsPostRestartChecksInterval                time.Duration         `yaml:"os_post_restart_checks_interval"`
+	OsPostRestartChecksTimeout                 time.Duration         `yaml:"os_post_restart_checks_timeout"`
+	RestartRequestDeadline                     time.Duration         `yaml:"restart_request_deadline"`
+	RestartRequestMaxAttempts                  int                   `yaml:"restart_request_max_attempts"`
+	DaemonInterval                             time.Duration         `yaml:"daemon_interval"`
+	StateFile                                  string                `yaml:"state_file"`
+	StateMaxAge                                time.Duration         `yaml:"state_max_age"`
+	DaemonJitter                               time.Duration         `yaml:"daemon_jitter"`
+	Facts                                      factsSettings         `yaml:"facts"`
+	RequestDeadline                            time.Duration         `yaml:"request_deadline"`
+	RequestRetries                             int                   `yaml:"request_retries"`
+	RetryBackoffMin                            time.Duration         `yaml:"retry_backoff_min"`
+	RetryBackoffMax                            time.Duration         `yaml:"retry_backoff_max"`
+	DisabledWarningAge                         time.Duration         `yaml:"disabled_warning_age"`
+	DisableStatusReport                        bool                  `yaml:"disable_status_report"`
+	MaintenanceWindows                         []maintenanceWindow   `yaml:"maintenance_windows"`
+	Blackouts                                  []blackout            `yaml:"blackouts"`
+	BlackoutsDir                               string                `yaml:"blackouts_dir"`
+	RestartAction                              restartActionSettings `yaml:"restart_action"`
 }
 
-// readConfigfile creates the configSettings struct from the config file
+// factsSettings enables the collectors of facts about the host, which are sent with each request
+type factsSettings struct {
+	Kernel      bool              `yaml:"kernel"`
+	OSRelease   bool              `yaml:"os_release"`
+	BootID      bool              `yaml:"boot_id"`
+	LoadAverage bool              `yaml:"load_average"`
+	Users       bool              `yaml:"users"`
+	MachineID   bool              `yaml:"machine_id"`
+	Labels      map[string]string `yaml:"labels"`
+}
+
+// UnmarshalYAML reads durations without unit as seconds, because plain numbers would otherwise
+// be interpreted as nanoseconds
+func (config *configSettings) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plainSettings configSettings
+	if err := unmarshal((*plainSettings)(config)); err != nil {
+		return err
+	}
+	var values map[string]interface{}
+	if err := unmarshal(&values); err != nil {
+		return err
+	}
+	for setting, duration := range config.durations() {
+		if seconds, ok := values[setting].(int); ok {
+			*duration = time.Duration(seconds) * time.Second
+		}
+	}
+	return nil
+}
+
+// durations returns the duration settings by their name in the config file
+func (config *configSettings) durations() map[string]*time.Duration {
+	return map[string]*time.Duration{
+		"timeout":                           &config.Timeout,
+		"restart_condition_script_timeout":  &config.RestartConditionScriptTimeout,
+		"restart_condition_scripts_timeout": &config.RestartConditionScriptsTimeout,
+		"os_restart_hooks_timeout":          &config.OsRestartHooksTimeout,
+		"os_post_restart_checks_deadline":   &config.OsPostRestartChecksDeadline,
+		"os_post_restart_checks_interval":   &config.OsPostRestartChecksInterval,
+		"os_post_restart_checks_timeout":    &config.OsPostRestartChecksTimeout,
+		"restart_request_deadline":          &config.RestartRequestDeadline,
+		"daemon_interval":                   &config.DaemonInterval,
+		"daemon_jitter":                     &config.DaemonJitter,
+		"state_max_age":                     &config.StateMaxAge,
+		"request_deadline":                  &config.RequestDeadline,
+		"retry_backoff_min":                 &config.RetryBackoffMin,
+		"retry_backoff_max":                 &config.RetryBackoffMax,
+		"disabled_warning_age":              &config.DisabledWarningAge,
+	}
+}
+
+// readConfigfile creates the configSettings struct from the config file and exits on errors
 func readConfigfile(configFile string) configSettings {
+	config, err := loadConfigfile(configFile)
+	if err != nil {
+		h.Fatalf(err.Error())
+	}
+	return config
+}
+
+// loadConfigfile creates the configSettings struct from the config file
+func loadConfigfile(configFile string) (configSettings, error) {
+	var config configSettings
 	if !h.FileExists(configFile) {
-		h.Fatalf("config file '" + configFile + "' not found!")
+		return config, errors.New("config file '" + configFile + "' not found!")
 	}
 	h.Debugf("Trying to read config file: " + configFile)
 	data, err := ioutil.ReadFile(configFile)
 	if err != nil {
-		h.Fatalf("readConfigfile(): There was an error parsing the config file " + configFile + ": " + err.Error())
+		return config, errors.New("There was an error parsing the config file " + configFile + ": " + err.Error())
 	}
 
-	var config configSettings
 	err = yaml.Unmarshal([]byte(data), &config)
 	if err != nil {
-		h.Fatalf("In config file " + configFile + ": YAML unmarshal error: " + err.Error())
+		return config, errors.New("In config file " + configFile + ": YAML unmarshal error: " + err.Error())
 	}
 
 	//fmt.Print("config: ")
@@ -47,43 +146,233 @@ func readConfigfile(configFile string) configSettings {
 
 	// set default timeout to 5 seconds if no timeout setting found
 	if config.Timeout == 0 {
-		config.Timeout = 5
+		config.Timeout = 5 * time.Second
+	}
+	// retry failed requests to the goahead service up to 5 times within 1 minute
+	if config.RequestDeadline == 0 {
+		config.RequestDeadline = time.Minute
+	}
+	if config.RequestRetries == 0 {
+		config.RequestRetries = 5
+	}
+	if config.RetryBackoffMin == 0 {
+		config.RetryBackoffMin = time.Second
+	}
+	if config.RetryBackoffMax == 0 {
+		config.RetryBackoffMax = 30 * time.Second
+	}
+	if config.Timeout < 0 || config.RequestDeadline < 0 || config.RetryBackoffMin < 0 || config.RetryBackoffMax < 0 {
+		return config, errors.New("timeout, request_deadline, retry_backoff_min and retry_backoff_max must not be negative in config file: " + configFile)
+	}
+	if config.RetryBackoffMax < config.RetryBackoffMin {
+		return config, errors.New("retry_backoff_max must not be lower than retry_backoff_min in config file: " + configFile)
 	}
 
-	if len(config.ServiceUrl) < 1 {
-		h.Fatalf("Missing service_url setting in config file: " + configFile)
+	// give up asking for a restart after 30 minutes if no restart_request_deadline is configured
+	if config.RestartRequestDeadline == 0 {
+		config.RestartRequestDeadline = 30 * time.Minute
 	}
-	_, err = url.ParseRequestURI(config.ServiceUrl)
-	if err != nil {
-		h.Fatalf("Failed to parse/validate service_url setting " + config.ServiceUrl + " in config file: " + configFile)
+	if config.RestartRequestDeadline < 0 {
+		return config, errors.New("restart_request_deadline must not be negative in config file: " + configFile)
+	}
+
+	if len(config.StateFile) == 0 {
+		config.StateFile = "/var/lib/goahead/state.json"
+	}
+	// continue restart requests which are not older than 2 hours
+	if config.StateMaxAge == 0 {
+		config.StateMaxAge = 2 * time.Hour
+	}
+	if config.StateMaxAge < 0 {
+		return config, errors.New("state_max_age must not be negative in config file: " + configFile)
+	}
+
+	// warn about administrative disables which are older than a week, a negative value never warns
+	if config.DisabledWarningAge == 0 {
+		config.DisabledWarningAge = 7 * 24 * time.Hour
+	}
+
+	// run every hour in daemon mode, spread by up to a tenth of the interval
+	if config.DaemonInterval == 0 {
+		config.DaemonInterval = time.Hour
+	}
+	if config.DaemonJitter == 0 {
+		config.DaemonJitter = config.DaemonInterval / 10
+	}
+	if config.DaemonInterval < 0 || config.DaemonJitter < 0 {
+		return config, errors.New("daemon_interval and daemon_jitter must not be negative in config file: " + configFile)
+	}
+
+	if config.RestartRequestMaxAttempts < 0 {
+		return config, errors.New("restart_request_max_attempts must not be negative in config file: " + configFile)
+	}
+
+	if len(config.ServiceUrl) < 1 && len(config.ServiceUrls) < 1 && len(config.ServiceSrv) < 1 {
+		return config, errors.New("Missing service_url, service_urls or service_srv setting in config file: " + configFile)
+	}
+	if len(config.ServiceUrl) > 0 {
+		_, err = url.ParseRequestURI(config.ServiceUrl)
+		if err != nil {
+			return config, errors.New("Failed to parse/validate service_url setting " + config.ServiceUrl + " in config file: " + configFile)
+		}
+		if !strings.HasSuffix(config.ServiceUrl, "/") {
+			config.ServiceUrl = config.ServiceUrl + "/"
+		}
+	}
+	for i, serviceUrl := range config.ServiceUrls {
+		_, err = url.ParseRequestURI(serviceUrl)
+		if err != nil {
+			return config, errors.New("Failed to parse/validate service_urls entry " + serviceUrl + " in config file: " + configFile)
+		}
+		if !strings.HasSuffix(serviceUrl, "/") {
+			config.ServiceUrls[i] = serviceUrl + "/"
+		}
+	}
+	// try the service URLs in the configured order if no service_url_selection is configured
+	if len(config.ServiceUrlSelection) == 0 {
+		config.ServiceUrlSelection = "ordered"
+	}
+	if config.ServiceUrlSelection != "ordered" && config.ServiceUrlSelection != "random" {
+		return config, errors.New("service_url_selection must be ordered or random, found " + config.ServiceUrlSelection + " in config file: " + configFile)
 	}
-	if !strings.HasSuffix(config.ServiceUrl, "/") {
-		config.ServiceUrl = config.ServiceUrl + "/"
+	if len(config.ServiceSrvScheme) == 0 {
+		config.ServiceSrvScheme = "https"
+	}
+	if config.ServiceSrvScheme != "https" && config.ServiceSrvScheme != "http" {
+		return config, errors.New("service_srv_scheme must be https or http, found " + config.ServiceSrvScheme + " in config file: " + configFile)
 	}
 
 	if len(config.ServiceUrlCaFile) > 0 && !h.FileExists(config.ServiceUrlCaFile) {
-		h.Fatalf("Failed to find configured service_url_ca_file " + config.ServiceUrlCaFile)
+		return config, errors.New("Failed to find configured service_url_ca_file " + config.ServiceUrlCaFile)
 	}
 
 	if len(config.PrivateKey) > 0 && !h.FileExists(config.PrivateKey) {
-		h.Fatalf("Failed to find configured ssl_private_key " + config.PrivateKey)
+		return config, errors.New("Failed to find configured ssl_private_key " + config.PrivateKey)
 	}
 
 	if len(config.CertificateFile) > 0 && !h.FileExists(config.CertificateFile) {
-		h.Fatalf("Failed to find configured ssl_certificate_file " + config.CertificateFile)
+		return config, errors.New("Failed to find configured ssl_certificate_file " + config.CertificateFile)
+	}
+
+	if (len(config.PrivateKey) > 0) != (len(config.CertificateFile) > 0) {
+		return config, errors.New("ssl_private_key and ssl_certificate_file need to be configured together in config file: " + configFile)
+	}
+
+	if config.RequireAndVerifyClientCert && (len(config.PrivateKey) < 1 || len(config.CertificateFile) < 1) {
+		return config, errors.New("ssl_require_and_verify_client_cert is enabled, but ssl_private_key and ssl_certificate_file are not configured in config file: " + configFile)
 	}
 
+	for _, detector := range config.RestartConditionDetectors {
+		if _, ok := restartConditionDetectors[detector]; !ok {
+			return config, errors.New("Unknown restart_condition_detectors entry " + detector + " in config file: " + configFile)
+		}
+	}
 	if len(config.RestartConditionScript) < 1 {
-		h.Fatalf("Missing restart_condition_script setting in config file: " + configFile)
+		if len(config.RestartConditionDetectors) < 1 && len(config.RestartConditionScriptsDir) < 1 {
+			return config, errors.New("Missing restart_condition_script, restart_condition_scripts_dir or restart_condition_detectors setting in config file: " + configFile)
+		}
 	} else if !h.FileExists(config.RestartConditionScript) {
-		h.Fatalf("Failed to find configured restart_condition_script " + config.RestartConditionScript)
+		return config, errors.New("Failed to find configured restart_condition_script " + config.RestartConditionScript)
+	}
+	if config.RestartConditionScriptTimeout == 0 {
+		config.RestartConditionScriptTimeout = 5 * time.Second
+	}
+	if config.RestartConditionScriptTimeout < 0 {
+		return config, errors.New("restart_condition_script_timeout must not be negative in config file: " + configFile)
+	}
+	// truncate the text of each restart reason to 1024 characters
+	if config.RestartReasonMaxLength == 0 {
+		config.RestartReasonMaxLength = 1024
+	}
+	if len(config.RestartConditionScriptsDir) > 0 && !h.IsDir(config.RestartConditionScriptsDir) {
+		return config, errors.New("Failed to find configured restart_condition_scripts_dir " + config.RestartConditionScriptsDir)
+	}
+	// run up to 4 restart condition scripts in parallel, each for up to 30 seconds
+	if config.RestartConditionScriptsConcurrency == 0 {
+		config.RestartConditionScriptsConcurrency = 4
+	}
+	if config.RestartConditionScriptsTimeout == 0 {
+		config.RestartConditionScriptsTimeout = 30 * time.Second
+	}
+	if config.RestartConditionScriptsConcurrency < 0 || config.RestartConditionScriptsTimeout < 0 {
+		return config, errors.New("restart_condition_scripts_concurrency and restart_condition_scripts_timeout must not be negative in config file: " + configFile)
+	}
+	// the scripts of restart_condition_scripts_dir vote with exit code 1 for and 0 against a restart
+	if config.RestartConditionScriptsExitCodeForReboot == 0 && config.RestartConditionScriptsExitCodeForNoReboot == 0 {
+		config.RestartConditionScriptsExitCodeForReboot = 1
+	}
+	if config.RestartConditionScriptsExitCodeForReboot == config.RestartConditionScriptsExitCodeForNoReboot {
+		return config, errors.New("restart_condition_scripts_exit_code_for_reboot and restart_condition_scripts_exit_code_for_no_reboot must differ in config file: " + configFile)
+	}
+
+	for i := range config.MaintenanceWindows {
+		if err := config.MaintenanceWindows[i].parse(); err != nil {
+			return config, errors.New("Invalid maintenance_windows entry " + strconv.Itoa(i+1) + ": " + err.Error() + " in config file: " + configFile)
+		}
 	}
 
+	for i := range config.Blackouts {
+		config.Blackouts[i].Source = configFile
+		if err := config.Blackouts[i].parse(); err != nil {
+			return config, errors.New("Invalid blackouts entry " + strconv.Itoa(i+1) + ": " + err.Error() + " in config file: " + configFile)
+		}
+	}
+	if len(config.BlackoutsDir) > 0 && !h.IsDir(config.BlackoutsDir) {
+		return config, errors.New("Failed to find configured blackouts_dir " + config.BlackoutsDir)
+	}
+
+	if len(config.RestartAction.Type) > 0 {
+		if _, ok := restartActions[config.RestartAction.Type]; !ok {
+			return config, errors.New("Unknown restart_action type " + config.RestartAction.Type + " in config file: " + configFile)
+		}
+		if config.RestartAction.Type == "command" && len(config.RestartAction.Command) == 0 {
+			return config, errors.New("Missing restart_action command for restart_action type command in config file: " + configFile)
+		}
+		if config.RestartAction.Delay < 0 || config.RestartAction.Timeout < 0 {
+			return config, errors.New("restart_action delay and timeout must not be negative in config file: " + configFile)
+		}
+		// the command which triggers the restart should return quickly
+		if config.RestartAction.Timeout == 0 {
+			config.RestartAction.Timeout = 30 * time.Second
+		}
+	}
+
+	// the restart hooks are optional if the client restarts the host itself
 	if len(config.OsRestartHooksDir) < 1 {
-		h.Fatalf("Missing os_restart_hooks_dir setting in config file: " + configFile)
+		if len(config.RestartAction.Type) == 0 {
+			return config, errors.New("Missing os_restart_hooks_dir or restart_action setting in config file: " + configFile)
+		}
 	} else if !h.FileExists(config.OsRestartHooksDir) {
-		h.Fatalf("Failed to find configured os_restart_hooks_dir " + config.OsRestartHooksDir)
+		return config, errors.New("Failed to find configured os_restart_hooks_dir " + config.OsRestartHooksDir)
+	}
+	// hooks without a timeout of their own are killed after 10 seconds
+	if config.OsRestartHooksTimeout == 0 {
+		config.OsRestartHooksTimeout = 10 * time.Second
+	}
+	if config.OsRestartHooksTimeout < 0 {
+		return config, errors.New("os_restart_hooks_timeout must not be negative in config file: " + configFile)
 	}
 
-	return config
+	if len(config.OsPostRestartChecksDir) > 0 && !h.IsDir(config.OsPostRestartChecksDir) {
+		return config, errors.New("Failed to find configured os_post_restart_checks_dir " + config.OsPostRestartChecksDir)
+	}
+	// retry failing post restart checks every 30 seconds for up to 10 minutes
+	if config.OsPostRestartChecksDeadline == 0 {
+		config.OsPostRestartChecksDeadline = 10 * time.Minute
+	}
+	if config.OsPostRestartChecksInterval == 0 {
+		config.OsPostRestartChecksInterval = 30 * time.Second
+	}
+	if config.OsPostRestartChecksDeadline < 0 || config.OsPostRestartChecksInterval < 0 {
+		return config, errors.New("os_post_restart_checks_deadline and os_post_restart_checks_interval must not be negative in config file: " + configFile)
+	}
+	// a single post restart check is killed after 10 seconds
+	if config.OsPostRestartChecksTimeout == 0 {
+		config.OsPostRestartChecksTimeout = 10 * time.Second
+	}
+	if config.OsPostRestartChecksTimeout < 0 {
+		return config, errors.New("os_post_restart_checks_timeout must not be negative in config file: " + configFile)
+	}
+
+	return config, nil
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigfileDurations(t *testing.T) {
+	baseContent := "---\n" +
+		"service_url: http://localhost/\n" +
+		"restart_condition_script: ./tests/always-false.sh\n" +
+		"os_restart_hooks_dir: ./tests/TestRestartHooks/\n"
+
+	tests := []struct {
+		setting  string
+		value    string
+		expected time.Duration
+		field    func(c configSettings) time.Duration
+	}{
+		{"timeout", "7", 7 * time.Second, func(c configSettings) time.Duration { return c.Timeout }},
+		{"restart_condition_script_timeout", "7", 7 * time.Second, func(c configSettings) time.Duration { return c.RestartConditionScriptTimeout }},
+		{"restart_condition_scripts_timeout", "7", 7 * time.Second, func(c configSettings) time.Duration { return c.RestartConditionScriptsTimeout }},
+		{"os_restart_hooks_timeout", "7", 7 * time.Second, func(c configSettings) time.Duration { return c.OsRestartHooksTimeout }},
+		{"os_post_restart_checks_deadline", "7", 7 * time.Second, func(c configSettings) time.Duration { return c.OsPostRestartChecksDeadline }},
+		{"os_post_restart_checks_interval", "7", 7 * time.Second, func(c configSettings) time.Duration { return c.OsPostRestartChecksInterval }},
+		{"os_post_restart_checks_timeout", "7", 7 * time.Second, func(c configSettings) time.Duration { return c.OsPostRestartChecksTimeout }},
+		{"restart_request_deadline", "7", 7 * time.Second, func(c configSettings) time.Duration { return c.RestartRequestDeadline }},
+		{"daemon_interval", "7", 7 * time.Second, func(c configSettings) time.Duration { return c.DaemonInterval }},
+		{"daemon_jitter", "7", 7 * time.Second, func(c configSettings) time.Duration { return c.DaemonJitter }},
+		{"state_max_age", "7", 7 * time.Second, func(c configSettings) time.Duration { return c.StateMaxAge }},
+		{"request_deadline", "7", 7 * time.Second, func(c configSettings) time.Duration { return c.RequestDeadline }},
+		{"retry_backoff_min", "7", 7 * time.Second, func(c configSettings) time.Duration { return c.RetryBackoffMin }},
+		{"retry_backoff_max", "70", 70 * time.Second, func(c configSettings) time.Duration { return c.RetryBackoffMax }},
+		{"disabled_warning_age", "7", 7 * time.Second, func(c configSettings) time.Duration { return c.DisabledWarningAge }},
+		{"timeout", "1m30s", 90 * time.Second, func(c configSettings) time.Duration { return c.Timeout }},
+		{"restart_request_deadline", "2h", 2 * time.Hour, func(c configSettings) time.Duration { return c.RestartRequestDeadline }},
+	}
+	dir := t.TempDir()
+	for _, test := range tests {
+		configFile := filepath.Join(dir, "client.yml")
+		if err := os.WriteFile(configFile, []byte(baseContent+test.setting+": "+test.value+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		loadedConfig, err := loadConfigfile(configFile)
+		if err != nil {
+			t.Errorf("%s: %s returned error %v", test.setting, test.value, err)
+		} else if test.field(loadedConfig) != test.expected {
+			t.Errorf("%s: %s was read as %s, but we expected %s", test.setting, test.value, test.field(loadedConfig), test.expected)
+		}
+	}
+
+	// a negative duration is rejected, only disabled_warning_age uses it to never warn
+	for setting := range (&configSettings{}).durations() {
+		configFile := filepath.Join(dir, "client.yml")
+		if err := os.WriteFile(configFile, []byte(baseContent+setting+": -7\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadConfigfile(configFile)
+		if setting == "disabled_warning_age" && err != nil {
+			t.Errorf("%s: -7 returned error %v, but a negative value should never warn", setting, err)
+		} else if setting != "disabled_warning_age" && err == nil {
+			t.Errorf("%s: -7 was accepted, but we expected an error", setting)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	h "github.com/xorpaul/gohelper"
+)
+
+// runDaemon keeps the goahead client running and executes the same flow as a single run every
+// daemon_interval (plus a random daemon_jitter). The http client and a pending request_id are kept
+// between the runs.
+//
+// SIGHUP reloads the config file, SIGTERM/SIGINT stop the daemon. If a run is in progress during
+// SIGTERM/SIGINT an ongoing restart negotiation gets aborted, while already running restart hooks
+// are allowed to finish. A second SIGTERM/SIGINT exits immediately.
+func runDaemon(configFile string, disabledFile string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	h.Infof("Starting goahead client daemon with daemon_interval " + config.DaemonInterval.String() + " and daemon_jitter " + config.DaemonJitter.String())
+	wait := jitter(config.DaemonJitter)
+	for {
+		h.Infof("Next run in " + wait.Round(time.Second).String())
+		timer := time.NewTimer(wait)
+	waiting:
+		for {
+			select {
+			case sig := <-signals:
+				if sig == syscall.SIGHUP {
+					reloadConfig(configFile)
+					continue
+				}
+				timer.Stop()
+				h.Infof("Received " + sig.String() + ", stopping goahead client daemon")
+				return
+			case <-timer.C:
+				break waiting
+			}
+		}
+
+		if stop := runDaemonCycle(configFile, disabledFile, signals); stop {
+			return
+		}
+		wait = config.DaemonInterval + jitter(config.DaemonJitter)
+	}
+}
+
+// runDaemonCycle executes one run while handling signals and returns true if the daemon should stop
+func runDaemonCycle(configFile string, disabledFile string, signals chan os.Signal) bool {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan int, 1)
+	go func() {
+		exitCode := exitCodeOK
+		if !isDisabled(disabledFile) {
+			exitCode = doMain(ctx)
+		}
+		done <- exitCode
+	}()
+
+	stop := false
+	reload := false
+	for {
+		select {
+		case exitCode := <-done:
+			h.Infof("Finished run with exit code " + strconv.Itoa(exitCode))
+			// the running cycle uses the global config, so a requested reload is applied afterwards
+			if reload && !stop {
+				reloadConfig(configFile)
+			}
+			return stop
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				h.Infof("Received " + sig.String() + ", reloading config file after the current run")
+				reload = true
+			} else if stop {
+				h.Fatalf("Received " + sig.String() + " again, exiting immediately")
+			} else {
+				h.Infof("Received " + sig.String() + ", aborting the current run and stopping goahead client daemon")
+				stop = true
+				cancel()
+			}
+		}
+	}
+}
+
+// reloadConfig replaces the config and http client, a broken config file keeps the previous settings
+func reloadConfig(configFile string) {
+	h.Infof("Reloading config file " + configFile)
+	newConfig, err := loadConfigfile(configFile)
+	if err != nil {
+		h.Infof("Keeping previous config, because the config file could not be loaded: " + err.Error())
+		return
+	}
+	newGoaheadClient, err := newClient(newConfig)
+	if err != nil {
+		h.Infof("Keeping previous config, because the goahead client could not be created: " + err.Error())
+		return
+	}
+	config = newConfig
+	client = newGoaheadClient
+}
+
+// jitter returns a random duration between 0 and max
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
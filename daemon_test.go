@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	H "github.com/xorpaul/gohelper"
+)
+
+func TestDaemon(t *testing.T) {
+	if os.Getenv("TEST_FOR_CRASH_"+H.FuncName()) == "1" {
+		H.Info = true
+		configFile := filepath.Join(t.TempDir(), "client.yml")
+		configContent := "---\n" +
+			"service_url: " + ts.URL + "/\n" +
+			"restart_condition_script: ./tests/always-false.sh\n" +
+			"os_restart_hooks_dir: ./tests/TestRestartHooks/\n" +
+			"daemon_interval: 100ms\n"
+		if err := os.WriteFile(configFile, []byte(configContent), 0644); err != nil {
+			t.Fatal(err)
+		}
+		config = readConfigfile(configFile)
+		client = setupClient()
+		runDaemon(configFile, "/nonexistent/goahead/disabled")
+		os.Exit(0)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run="+H.FuncName()+"$")
+	cmd.Env = append(os.Environ(), "TEST_FOR_CRASH_"+H.FuncName()+"=1")
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Stdout = w
+	cmd.Stderr = w
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	var out []string
+	waitFor := func(expectedLine string) {
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					t.Fatalf("daemon exited before logging '%s' Output: %s", expectedLine, strings.Join(out, "\n"))
+				}
+				out = append(out, line)
+				if strings.Contains(line, expectedLine) {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("timed out waiting for '%s' Output: %s", expectedLine, strings.Join(out, "\n"))
+			}
+		}
+	}
+
+	waitFor("Finished run with exit code 0")
+	waitFor("Finished run with exit code 0")
+	cmd.Process.Signal(syscall.SIGHUP)
+	waitFor("Reloading config file")
+	waitFor("Finished run with exit code 0")
+	cmd.Process.Signal(syscall.SIGTERM)
+	waitFor("stopping goahead client daemon")
+	for line := range lines {
+		out = append(out, line)
+	}
+
+	err = cmd.Wait()
+	exitCode := 0
+	if msg, ok := err.(*exec.ExitError); ok { // there is error code
+		exitCode = msg.Sys().(syscall.WaitStatus).ExitStatus()
+	}
+	if 0 != exitCode {
+		t.Errorf("terminated with %v, but we expected exit status %v Output: %s", exitCode, 0, strings.Join(out, "\n"))
+	}
+}
+
+func TestJitter(t *testing.T) {
+	if j := jitter(0); j != 0 {
+		t.Errorf("jitter(0) returned %s, but we expected 0", j)
+	}
+	for i := 0; i < 100; i++ {
+		if j := jitter(time.Second); j < 0 || j >= time.Second {
+			t.Errorf("jitter(1s) returned %s, which is not between 0 and 1s", j)
+		}
+	}
+}
+
+func TestDaemonCycleRuntimeErrors(t *testing.T) {
+	savedConfig := config
+	defer func() { config = savedConfig }()
+	config.RestartConditionScript = ""
+	config.RestartConditionScriptsDir = "./tests/["
+	config.BlackoutsDir = "./tests/["
+
+	// a broken glob pattern must end the run with an error instead of exiting the daemon
+	if stop := runDaemonCycle("./config.yml", "/nonexistent/goahead/disabled", make(chan os.Signal)); stop {
+		t.Errorf("runDaemonCycle requested to stop the daemon after a failed run")
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/xorpaul/goahead_client/goahead"
+	h "github.com/xorpaul/gohelper"
+)
+
+// the paths inspected by the built-in restart condition detectors
+var (
+	rebootRequiredFile     = "/var/run/reboot-required"
+	rebootRequiredPkgsFile = "/var/run/reboot-required.pkgs"
+	bootDir                = "/boot"
+	procDir                = "/proc"
+	microcodeDirs          = []string{"/lib/firmware/intel-ucode", "/lib/firmware/amd-ucode"}
+)
+
+// restartConditionDetectors are the built-in detectors which can be enabled via restart_condition_detectors.
+// Each detector returns a human-readable reason if the host needs to be restarted.
+var restartConditionDetectors = map[string]func() string{
+	"reboot_required":   detectRebootRequired,
+	"kernel":            detectKernelUpdate,
+	"deleted_libraries": detectDeletedLibraries,
+	"microcode":         detectMicrocodeUpdate,
+}
+
+// runRestartConditionDetectors executes the configured detectors and returns their restart reasons
+func runRestartConditionDetectors() []goahead.RestartReason {
+	var reasons []goahead.RestartReason
+	for _, name := range config.RestartConditionDetectors {
+		reason := restartConditionDetectors[name]()
+		if len(reason) > 0 {
+			h.Infof("Restart condition detector " + name + " found reason to restart: " + reason)
+			reasons = append(reasons, goahead.RestartReason{Source: name, Type: name, Reason: reason})
+		} else {
+			h.Debugf("Restart condition detector " + name + " did not find a reason to restart")
+		}
+	}
+	return reasons
+}
+
+// detectRebootRequired checks for the file Debian based distributions create if an updated package
+// requires a restart
+func detectRebootRequired() string {
+	if !h.FileExists(rebootRequiredFile) {
+		return ""
+	}
+	reason := rebootRequiredFile + " exists"
+	data, err := os.ReadFile(rebootRequiredPkgsFile)
+	if err == nil {
+		packages := uniqueLines(string(data))
+		if len(packages) > 0 {
+			reason = reason + ", required by packages: " + strings.Join(packages, ", ")
+		}
+	}
+	return reason
+}
+
+// detectKernelUpdate compares the running kernel with the newest kernel installed in /boot
+func detectKernelUpdate() string {
+	osrelease := filepath.Join(procDir, "sys/kernel/osrelease")
+	data, err := os.ReadFile(osrelease)
+	if err != nil {
+		h.Debugf("Could not read running kernel version from " + osrelease + " Error: " + err.Error())
+		return ""
+	}
+	running := strings.TrimSpace(string(data))
+
+	newest := newestKernel()
+	if len(newest) == 0 {
+		h.Debugf("Could not find any installed kernels in " + bootDir)
+		return ""
+	}
+	if compareVersions(newest, running) > 0 {
+		return "Running kernel " + running + ", but newer kernel " + newest + " is installed"
+	}
+	return ""
+}
+
+// newestKernel returns the version of the newest kernel installed in /boot or an empty string
+func newestKernel() string {
+	kernels, _ := filepath.Glob(filepath.Join(bootDir, "vmlinuz-*"))
+	newest := ""
+	for _, kernel := range kernels {
+		version := strings.TrimPrefix(filepath.Base(kernel), "vmlinuz-")
+		if len(newest) == 0 || compareVersions(version, newest) > 0 {
+			newest = version
+		}
+	}
+	return newest
+}
+
+// detectDeletedLibraries finds processes which still map shared libraries that were deleted or
+// replaced by a package update
+func detectDeletedLibraries() string {
+	mapsFiles, err := filepath.Glob(filepath.Join(procDir, "[0-9]*", "maps"))
+	if err != nil {
+		h.Debugf("Failed to glob process maps in " + procDir + " Error: " + err.Error())
+		return ""
+	}
+	var processes []string
+	libraries := make(map[string]bool)
+	for _, mapsFile := range mapsFiles {
+		data, err := os.ReadFile(mapsFile)
+		if err != nil {
+			// the process might be gone already or we are not allowed to read it
+			continue
+		}
+		found := false
+		for _, line := range strings.Split(string(data), "\n") {
+			if !strings.HasSuffix(line, " (deleted)") {
+				continue
+			}
+			fields := strings.Fields(strings.TrimSuffix(line, " (deleted)"))
+			if len(fields) < 6 {
+				continue
+			}
+			library := fields[5]
+			if !strings.HasPrefix(library, "/") || !strings.Contains(filepath.Base(library), ".so") {
+				continue
+			}
+			libraries[library] = true
+			found = true
+		}
+		if found {
+			pidDir := filepath.Dir(mapsFile)
+			name := filepath.Base(pidDir)
+			if comm, err := os.ReadFile(filepath.Join(pidDir, "comm")); err == nil {
+				name = strings.TrimSpace(string(comm)) + "(" + name + ")"
+			}
+			processes = append(processes, name)
+		}
+	}
+	if len(processes) == 0 {
+		return ""
+	}
+	sort.Strings(processes)
+	var libraryNames []string
+	for library := range libraries {
+		libraryNames = append(libraryNames, library)
+	}
+	sort.Strings(libraryNames)
+	return strconv.Itoa(len(processes)) + " processes use deleted libraries: " + abbreviateList(processes, 10) + " libraries: " + abbreviateList(libraryNames, 10)
+}
+
+// detectMicrocodeUpdate checks for CPU microcode files which were updated since the last boot. The
+// ctime is compared, because package managers keep the mtime of the packaged files.
+func detectMicrocodeUpdate() string {
+	bootTime, err := getBootTime()
+	if err != nil {
+		h.Debugf(err.Error())
+		return ""
+	}
+	candidates, _ := filepath.Glob(filepath.Join(bootDir, "*ucode*"))
+	for _, dir := range microcodeDirs {
+		files, _ := filepath.Glob(filepath.Join(dir, "*"))
+		candidates = append(candidates, files...)
+	}
+	var updated []string
+	for _, candidate := range candidates {
+		fi, err := os.Stat(candidate)
+		if err != nil || fi.IsDir() {
+			continue
+		}
+		if changeTime(fi).After(bootTime) {
+			updated = append(updated, candidate)
+		}
+	}
+	if len(updated) == 0 {
+		return ""
+	}
+	sort.Strings(updated)
+	return "Microcode was updated since the last boot at " + bootTime.Format(time.RFC3339) + ": " + abbreviateList(updated, 10)
+}
+
+// getBootTime reads the boot time from the btime line of /proc/stat
+func getBootTime() (time.Time, error) {
+	stat := filepath.Join(procDir, "stat")
+	data, err := os.ReadFile(stat)
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "btime" {
+			btime, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				break
+			}
+			return time.Unix(btime, 0), nil
+		}
+	}
+	return time.Time{}, os.ErrNotExist
+}
+
+// compareVersions compares version strings like 5.10.0-21-amd64 by comparing their numeric parts
+// numerically and all other parts lexically. It returns -1, 0 or 1.
+func compareVersions(a string, b string) int {
+	aParts := splitVersion(a)
+	bParts := splitVersion(b)
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		if aParts[i] == bParts[i] {
+			continue
+		}
+		aNumber, aErr := strconv.Atoi(aParts[i])
+		bNumber, bErr := strconv.Atoi(bParts[i])
+		if aErr == nil && bErr == nil {
+			if aNumber < bNumber {
+				return -1
+			}
+			return 1
+		}
+		if aParts[i] < bParts[i] {
+			return -1
+		}
+		return 1
+	}
+	if len(aParts) < len(bParts) {
+		return -1
+	} else if len(aParts) > len(bParts) {
+		return 1
+	}
+	return 0
+}
+
+// splitVersion splits a version string into runs of digits and other characters
+func splitVersion(version string) []string {
+	var parts []string
+	current := ""
+	for i, r := range version {
+		if i > 0 && unicode.IsDigit(r) != unicode.IsDigit(rune(current[len(current)-1])) {
+			parts = append(parts, current)
+			current = ""
+		}
+		current += string(r)
+	}
+	if len(current) > 0 {
+		parts = append(parts, current)
+	}
+	return parts
+}
+
+// uniqueLines returns the non-empty lines of the text without duplicates in their original order
+func uniqueLines(text string) []string {
+	var lines []string
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) > 0 && !seen[line] {
+			seen[line] = true
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// abbreviateList joins the first max items and mentions how many were left out
+func abbreviateList(items []string, max int) string {
+	if len(items) <= max {
+		return strings.Join(items, " ")
+	}
+	return strings.Join(items[:max], " ") + " and " + strconv.Itoa(len(items)-max) + " more"
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// changeTime returns the mtime of the file, the microcode detector only reads the ctime on Linux
+func changeTime(fi os.FileInfo) time.Time {
+	return fi.ModTime()
+}
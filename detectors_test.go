@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// useDetectorFixtures points the built-in restart condition detectors to the given directory
+func useDetectorFixtures(t *testing.T, root string) {
+	savedPaths := []string{rebootRequiredFile, rebootRequiredPkgsFile, bootDir, procDir}
+	savedMicrocodeDirs := microcodeDirs
+	t.Cleanup(func() {
+		rebootRequiredFile, rebootRequiredPkgsFile, bootDir, procDir = savedPaths[0], savedPaths[1], savedPaths[2], savedPaths[3]
+		microcodeDirs = savedMicrocodeDirs
+	})
+	rebootRequiredFile = filepath.Join(root, "var/run/reboot-required")
+	rebootRequiredPkgsFile = filepath.Join(root, "var/run/reboot-required.pkgs")
+	bootDir = filepath.Join(root, "boot")
+	procDir = filepath.Join(root, "proc")
+	microcodeDirs = []string{filepath.Join(root, "lib/firmware/intel-ucode")}
+}
+
+func TestRestartConditionDetectors(t *testing.T) {
+	useDetectorFixtures(t, "./tests/TestDetectors")
+
+	expectedReasons := map[string]string{
+		"reboot_required":   "tests/TestDetectors/var/run/reboot-required exists, required by packages: linux-image-5.10.0-21-amd64, libc6",
+		"kernel":            "Running kernel 5.10.0-20-amd64, but newer kernel 5.10.0-21-amd64 is installed",
+		"deleted_libraries": "1 processes use deleted libraries: sshd(1234) libraries: /usr/lib/x86_64-linux-gnu/libc.so.6 /usr/lib/x86_64-linux-gnu/libssl.so.3",
+		"microcode":         "Microcode was updated since the last boot at " + time.Unix(1000000000, 0).Format(time.RFC3339) + ": tests/TestDetectors/lib/firmware/intel-ucode/06-55-04",
+	}
+	for name, detector := range restartConditionDetectors {
+		if reason := detector(); reason != expectedReasons[name] {
+			t.Errorf("detector %s returned '%s', but we expected '%s'", name, reason, expectedReasons[name])
+		}
+	}
+}
+
+func TestRestartConditionDetectorsNoReason(t *testing.T) {
+	root := t.TempDir()
+	useDetectorFixtures(t, root)
+	for _, dir := range []string{"proc/sys/kernel", "proc/1", "boot", "lib/firmware/intel-ucode"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the ctime of the microcode file can not be set into the past, so the host boots after it
+	files := map[string]string{
+		"proc/sys/kernel/osrelease":         "6.1.0-13-amd64\n",
+		"proc/stat":                         "btime " + strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10) + "\n",
+		"proc/1/maps":                       "7f2b1c000000-7f2b1c022000 r--p 00000000 fd:01 1836513 /usr/lib/x86_64-linux-gnu/libc.so.6\n",
+		"boot/vmlinuz-6.1.0-13-amd64":       "",
+		"boot/vmlinuz-6.1.0-9-amd64":        "",
+		"lib/firmware/intel-ucode/06-55-04": "",
+	}
+	for file, content := range files {
+		if err := os.WriteFile(filepath.Join(root, file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, detector := range restartConditionDetectors {
+		if reason := detector(); len(reason) > 0 {
+			t.Errorf("detector %s returned '%s', but we expected no reason", name, reason)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"5.10.0-21-amd64", "5.10.0-20-amd64", 1},
+		{"5.10.0-9-amd64", "5.10.0-20-amd64", -1},
+		{"6.1.0-13-amd64", "5.10.0-20-amd64", 1},
+		{"5.10.0-20-amd64", "5.10.0-20-amd64", 0},
+		{"5.14.0-362.8.1.el9_3.x86_64", "5.14.0-362.13.1.el9_3.x86_64", -1},
+		{"5.10.0", "5.10.0-1", -1},
+	}
+	for _, test := range tests {
+		if got := compareVersions(test.a, test.b); got != test.expected {
+			t.Errorf("compareVersions(%s, %s) returned %d, but we expected %d", test.a, test.b, got, test.expected)
+		}
+	}
+}
+
+func TestDetectMicrocodeUpdate(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the ctime of the microcode files is only read on Linux")
+	}
+	root := t.TempDir()
+	useDetectorFixtures(t, root)
+	if err := os.MkdirAll(microcodeDirs[0], 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(procDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	bootTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.WriteFile(filepath.Join(procDir, "stat"), []byte("btime "+strconv.FormatInt(bootTime.Unix(), 10)+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// package managers keep the mtime of the packaged file, which was built before the boot
+	microcode := filepath.Join(microcodeDirs[0], "06-55-04")
+	if err := os.WriteFile(microcode, []byte("microcode"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	packaged := bootTime.AddDate(0, -1, 0)
+	if err := os.Chtimes(microcode, packaged, packaged); err != nil {
+		t.Fatal(err)
+	}
+	expected := "Microcode was updated since the last boot at " + bootTime.Format(time.RFC3339) + ": " + microcode
+	if reason := detectMicrocodeUpdate(); reason != expected {
+		t.Errorf("detectMicrocodeUpdate returned '%s', but we expected '%s'", reason, expected)
+	}
+}
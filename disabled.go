@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/xorpaul/goahead_client/goahead"
+	h "github.com/xorpaul/gohelper"
+)
+
+// disabledState is the administrative disable of the goahead client. The disable command writes it
+// as JSON to the disabled file, a plain text disabled file only contains the reason.
+type disabledState struct {
+	Reason     string    `json:"reason"`
+	DisabledBy string    `json:"disabled_by,omitempty"`
+	DisabledAt time.Time `json:"disabled_at"`
+	// Until is the time after which the goahead client enables itself again, zero means forever
+	Until time.Time `json:"until,omitzero"`
+}
+
+// String describes the disable for log messages
+func (d disabledState) String() string {
+	description := "Reason: '" + d.Reason + "'"
+	if len(d.DisabledBy) > 0 {
+		description = description + ", disabled by " + d.DisabledBy
+	}
+	if !d.DisabledAt.IsZero() {
+		description = description + " since " + d.DisabledAt.Format(time.RFC3339)
+	}
+	if !d.Until.IsZero() {
+		description = description + " until " + d.Until.Format(time.RFC3339)
+	}
+	return description
+}
+
+// isDisabled checks if the goahead run should be skipped, because the disabled file exists
+func isDisabled(disabledFile string) bool {
+	state, disabled := readDisabledState(disabledFile)
+	if disabled {
+		fmt.Printf("Notice: Skipping run of goahead client; administratively disabled (%s)\n", state)
+		if config.DisabledWarningAge > 0 && !state.DisabledAt.IsZero() && time.Since(state.DisabledAt) > config.DisabledWarningAge {
+			h.Infof("Warning: goahead client is disabled for " + time.Since(state.DisabledAt).Round(time.Minute).String() + ", which is longer than disabled_warning_age " + config.DisabledWarningAge.String() + ". Use goahead_client enable to enable it again.")
+		}
+		reportDisabledStatus(state)
+	}
+	return disabled
+}
+
+// reportDisabledStatus tells the goahead service that this host is disabled, unless
+// disable_status_report is set. A failed report is only logged, the run is skipped anyway.
+func reportDisabledStatus(state disabledState) {
+	if config.DisableStatusReport || client == nil {
+		return
+	}
+	report := goahead.StatusReport{
+		Status:         "disabled",
+		DisabledReason: state.Reason,
+		DisabledBy:     state.DisabledBy,
+		DisabledAt:     state.DisabledAt,
+		DisabledUntil:  state.Until,
+	}
+	if !state.DisabledAt.IsZero() {
+		report.DisabledAge = time.Since(state.DisabledAt).Round(time.Second).String()
+	}
+	// keep the report lightweight, a disabled host should not wait for the service
+	ctx, cancel := context.WithTimeout(context.Background(), config.Timeout)
+	defer cancel()
+	if _, err := client.ReportStatus(ctx, report); err != nil {
+		h.Infof("Could not report disabled status to goahead service. Error: " + err.Error())
+	}
+}
+
+// readDisabledState returns the disable from the disabled file and if the file exists. A disable
+// whose expiry has passed is removed, so the goahead client is enabled again.
+func readDisabledState(disabledFile string) (disabledState, bool) {
+	if !h.FileExists(disabledFile) {
+		return disabledState{}, false
+	}
+	data, err := os.ReadFile(disabledFile)
+	if err != nil {
+		// stay disabled, the disabled file exists even if it can not be read
+		h.Infof("Failed to read disabled file " + disabledFile + " Error: " + err.Error())
+		return disabledState{Reason: "disabled file can not be read: " + err.Error()}, true
+	}
+
+	var state disabledState
+	structured := false
+	content := strings.TrimSpace(string(data))
+	if strings.HasPrefix(content, "{") {
+		if err := json.Unmarshal(data, &state); err == nil {
+			structured = true
+		} else {
+			// stay disabled, the operator obviously wanted to disable the goahead client
+			h.Debugf("Failed to parse disabled file " + disabledFile + " as JSON, using it as plain text Error: " + err.Error())
+			state = disabledState{}
+		}
+	}
+	if !structured {
+		// plain text disabled file, which only contains the reason
+		state.Reason = strings.ReplaceAll(content, "\n", "")
+	}
+	if state.DisabledAt.IsZero() {
+		if fi, err := os.Stat(disabledFile); err == nil {
+			state.DisabledAt = fi.ModTime()
+		}
+	}
+	if len(state.Reason) == 0 {
+		state.Reason = "reason not specified"
+	}
+
+	if !state.Until.IsZero() && time.Now().After(state.Until) {
+		h.Infof("Administrative disable expired at " + state.Until.Format(time.RFC3339) + ", enabling goahead client again (" + state.String() + ")")
+		if err := os.Remove(disabledFile); err != nil && !os.IsNotExist(err) {
+			h.Infof("Failed to remove expired disabled file " + disabledFile + " Error: " + err.Error())
+		}
+		return disabledState{}, false
+	}
+	return state, true
+}
+
+// writeDisabledState writes the disable as JSON to the disabled file
+func writeDisabledState(disabledFile string, state disabledState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return errors.New("Failed to encode disabled state: " + err.Error())
+	}
+	return writeFileAtomically(disabledFile, append(data, '\n'))
+}
+
+// parseTimestamp parses the expiry of a disable and the times of blackouts, times without time zone
+// are local times
+func parseTimestamp(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04Z07:00"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("Failed to parse " + value + ", expected a time like 2026-11-01T00:00Z, 2026-11-01T00:00 or 2026-11-01")
+}
+
+// currentOperator returns the user who invoked the goahead client, also through sudo
+func currentOperator() string {
+	if sudoUser := os.Getenv("SUDO_USER"); len(sudoUser) > 0 {
+		return sudoUser
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadDisabledState(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name             string
+		content          string
+		expectedDisabled bool
+		expectedReason   string
+		expectedBy       string
+	}{
+		{"missing", "", false, "", ""},
+		{"plain", "kernel debugging\n", true, "kernel debugging", ""},
+		{"empty", "\n", true, "reason not specified", ""},
+		{"structured", `{"reason":"database migration","disabled_by":"alice","disabled_at":"2026-10-01T10:00:00Z","until":"2999-01-01T00:00:00Z"}`, true, "database migration", "alice"},
+		{"structured without expiry", `{"reason":"database migration","disabled_by":"alice","disabled_at":"2026-10-01T10:00:00Z"}`, true, "database migration", "alice"},
+		{"broken JSON", `{"reason":`, true, `{"reason":`, ""},
+		{"expired", `{"reason":"database migration","disabled_by":"alice","disabled_at":"2026-10-01T10:00:00Z","until":"2026-10-02T00:00:00Z"}`, false, "", ""},
+	}
+	for _, test := range tests {
+		disabledFile := filepath.Join(dir, test.name)
+		if test.name != "missing" {
+			if err := os.WriteFile(disabledFile, []byte(test.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		state, disabled := readDisabledState(disabledFile)
+		if disabled != test.expectedDisabled || state.Reason != test.expectedReason || state.DisabledBy != test.expectedBy {
+			t.Errorf("%s: readDisabledState returned %+v disabled %t, but we expected reason %q by %q disabled %t", test.name, state, disabled, test.expectedReason, test.expectedBy, test.expectedDisabled)
+		}
+		if disabled && state.DisabledAt.IsZero() {
+			t.Errorf("%s: disabled_at is not set", test.name)
+		}
+	}
+
+	// an expired disable is removed
+	if _, err := os.Stat(filepath.Join(dir, "expired")); !os.IsNotExist(err) {
+		t.Errorf("expired disabled file still exists")
+	}
+}
+
+func TestDisableCommand(t *testing.T) {
+	disabledFile := filepath.Join(t.TempDir(), "disabled")
+	options := &commandOptions{disabledFile: disabledFile}
+
+	for _, args := range [][]string{
+		{"disable"},
+		{"disable", "-reason", "migration", "-until", "2020-01-01"},
+		{"disable", "-reason", "migration", "-until", "next week"},
+		{"disable", "-reason", "migration", "-until", "2999-01-01", "-for", "1h"},
+	} {
+		if exitCode := runCommand(args, options); exitCode != 2 {
+			t.Errorf("command %q returned exit code %d, but we expected 2", args, exitCode)
+		}
+	}
+	if _, disabled := readDisabledState(disabledFile); disabled {
+		t.Fatalf("invalid disable commands disabled the goahead client")
+	}
+
+	if exitCode := runCommand([]string{"disable", "--reason", "database migration", "--until", "2999-11-01T00:00Z", "-by", "alice"}, options); exitCode != exitCodeOK {
+		t.Fatalf("disable command returned exit code %d", exitCode)
+	}
+	state, disabled := readDisabledState(disabledFile)
+	expectedUntil := time.Date(2999, 11, 1, 0, 0, 0, 0, time.UTC)
+	if !disabled || state.Reason != "database migration" || state.DisabledBy != "alice" || !state.Until.Equal(expectedUntil) || time.Since(state.DisabledAt) > time.Minute {
+		t.Errorf("disable command wrote %+v disabled %t", state, disabled)
+	}
+
+	if exitCode := runCommand([]string{"enable"}, options); exitCode != exitCodeOK {
+		t.Errorf("enable command returned exit code %d", exitCode)
+	}
+	if _, err := os.Stat(disabledFile); !os.IsNotExist(err) {
+		t.Errorf("enable command did not remove the disabled file")
+	}
+	if exitCode := runCommand([]string{"enable"}, options); exitCode != exitCodeOK {
+		t.Errorf("enable command of an enabled goahead client returned exit code %d", exitCode)
+	}
+
+	if exitCode := runCommand([]string{"disable", "-reason", "load test", "-for", "2h"}, options); exitCode != exitCodeOK {
+		t.Fatalf("disable command returned exit code %d", exitCode)
+	}
+	state, disabled = readDisabledState(disabledFile)
+	if !disabled || state.Until.Sub(state.DisabledAt) != 2*time.Hour {
+		t.Errorf("disable command with -for wrote %+v disabled %t", state, disabled)
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Time
+	}{
+		{"2026-11-01T00:00Z", time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)},
+		{"2026-11-01T08:30:00+02:00", time.Date(2026, 11, 1, 6, 30, 0, 0, time.UTC)},
+		{"2026-11-01T08:30", time.Date(2026, 11, 1, 8, 30, 0, 0, time.Local)},
+		{"2026-11-01", time.Date(2026, 11, 1, 0, 0, 0, 0, time.Local)},
+	}
+	for _, test := range tests {
+		result, err := parseTimestamp(test.value)
+		if err != nil || !result.Equal(test.expected) {
+			t.Errorf("parseTimestamp(%q) returned %s %v, but we expected %s", test.value, result, err, test.expected)
+		}
+	}
+	if _, err := parseTimestamp("tomorrow"); err == nil {
+		t.Errorf("parseTimestamp accepted tomorrow")
+	}
+}
+
+func TestReportDisabledStatus(t *testing.T) {
+	savedConfig := config
+	defer func() { config = savedConfig }()
+	fakeMutex.Lock()
+	fakeStatusReports = nil
+	fakeMutex.Unlock()
+
+	disabledFile := filepath.Join(t.TempDir(), "disabled")
+	disabledAt := time.Now().Add(-72 * time.Hour).Truncate(time.Second)
+	state := disabledState{Reason: "database migration", DisabledBy: "alice", DisabledAt: disabledAt}
+	if err := writeDisabledState(disabledFile, state); err != nil {
+		t.Fatal(err)
+	}
+	if !isDisabled(disabledFile) {
+		t.Fatalf("isDisabled returned false for an existing disabled file")
+	}
+
+	// air-gapped hosts do not report their status
+	config.DisableStatusReport = true
+	isDisabled(disabledFile)
+
+	fakeMutex.Lock()
+	defer fakeMutex.Unlock()
+	if len(fakeStatusReports) != 1 {
+		t.Fatalf("service received %d status reports, but we expected 1", len(fakeStatusReports))
+	}
+	report := fakeStatusReports[0]
+	if report.Status != "disabled" || report.DisabledReason != "database migration" || report.DisabledBy != "alice" || !report.DisabledAt.Equal(disabledAt) || !report.DisabledUntil.IsZero() {
+		t.Errorf("service received status report %+v, which does not match the disable %+v", report, state)
+	}
+	if age, err := time.ParseDuration(report.DisabledAge); err != nil || age < 72*time.Hour {
+		t.Errorf("service received disabled_age %s, but we expected at least 72h", report.DisabledAge)
+	}
+	if report.Fqdn != "foobar-server-aa02.domain.tld" || len(report.Uptime) == 0 {
+		t.Errorf("service received status report %+v without fqdn or uptime", report)
+	}
+}
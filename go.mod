@@ -3,13 +3,13 @@ module github.com/xorpaul/goahead_client
 go 1.24.2
 
 require (
+	github.com/kballard/go-shellquote v0.0.0-20180428030007-95032a82bc51
 	github.com/xorpaul/gohelper v0.0.0-20230404143020-51a25f54cce7
 	gopkg.in/yaml.v2 v2.4.0
 )
 
 require (
 	github.com/fatih/color v1.18.0 // indirect
-	github.com/kballard/go-shellquote v0.0.0-20180428030007-95032a82bc51 // indirect
 	github.com/mattn/go-colorable v0.1.14 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	golang.org/x/sys v0.32.0 // indirect
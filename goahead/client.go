@@ -0,0 +1,438 @@
+// Package goahead implements the protocol of the goahead service (https://github.com/xorpaul/goahead),
+// which coordinates the restarts of cluster nodes.
+package goahead
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config contains the settings to talk to the goahead service
+type Config struct {
+	// ServiceURL is the base URL of the goahead service, e.g. https://goahead.domain.tld/
+	ServiceURL string
+	// ServiceURLs are further base URLs of the goahead service, which are tried after ServiceURL if
+	// the service is not reachable
+	ServiceURLs []string
+	// ShuffleServiceURLs tries the service URLs in random instead of configured order
+	ShuffleServiceURLs bool
+	// ServiceSRV is the name of a DNS SRV record, e.g. _goahead._tcp.domain.tld, whose targets are
+	// tried before the service URLs. It is resolved before each request.
+	ServiceSRV string
+	// ServiceSRVScheme is the URL scheme of the SRV targets, defaults to https
+	ServiceSRVScheme string
+	// ServiceSRVResolver is the address of the DNS server for the SRV lookup, defaults to the system resolver
+	ServiceSRVResolver string
+	// CAFile is an optional PEM file with CA certificates to trust in addition to the system ones
+	CAFile string
+	// CertificateFile and PrivateKeyFile are the optional client certificate and key for mutual TLS
+	CertificateFile      string
+	PrivateKeyFile       string
+	PrivateKeyPassphrase string
+	// RequireClientCertificate makes New fail if no usable client certificate could be loaded
+	RequireClientCertificate bool
+	// Fqdn is sent as the requesting fqdn, defaults to the hostname
+	Fqdn string
+	// Uptime returns the uptime which is sent to the service, defaults to ReadUptime
+	Uptime func() (time.Duration, error)
+	// Facts returns the facts about the host which are sent with each request, optional
+	Facts func() *Facts
+	// DryRun tells the service that the restart will not be executed
+	DryRun bool
+	// Timeout limits each single HTTP request, defaults to 5 seconds
+	Timeout time.Duration
+	// RequestDeadline limits a request including all its retries, defaults to 1 minute
+	RequestDeadline time.Duration
+	// MaxRetries is the number of retries after connection errors and 5xx/429 responses, defaults to 5.
+	// Set it to a negative value to disable retries.
+	MaxRetries int
+	// BackoffMin and BackoffMax limit the exponential backoff between retries, default to 1s and 30s
+	BackoffMin time.Duration
+	BackoffMax time.Duration
+	// Debugf and Infof receive the log messages of the Client, which are discarded by default
+	Debugf func(string)
+	Infof  func(string)
+}
+
+// Request is the payload sent to the goahead service
+type Request struct {
+	Fqdn      string `json:"fqdn"`
+	Uptime    string `json:"uptime"`
+	RequestID string `json:"request_id,omitempty"`
+	// RestartReason contains the texts of all RestartReasons for services which do not know the list
+	RestartReason  string          `json:"restart_reason"`
+	RestartReasons []RestartReason `json:"restart_reasons,omitempty"`
+	Facts          *Facts          `json:"facts,omitempty"`
+	DryRun         bool            `json:"dry_run,omitempty"`
+}
+
+// Facts describe the host to allow the service to make better decisions, only collected facts are sent
+type Facts struct {
+	KernelRelease string            `json:"kernel_release,omitempty"`
+	OSRelease     *OSRelease        `json:"os_release,omitempty"`
+	BootID        string            `json:"boot_id,omitempty"`
+	LoadAverage   []float64         `json:"load_average,omitempty"`
+	Users         *int              `json:"users,omitempty"`
+	MachineID     string            `json:"machine_id,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+}
+
+// OSRelease contains the identifying fields of /etc/os-release
+type OSRelease struct {
+	ID              string `json:"id,omitempty"`
+	VersionID       string `json:"version_id,omitempty"`
+	VersionCodename string `json:"version_codename,omitempty"`
+	PrettyName      string `json:"pretty_name,omitempty"`
+}
+
+// RestartReason is a single reason why the host needs to be restarted
+type RestartReason struct {
+	// Source is the detector or script which found the reason
+	Source string `json:"source"`
+	// Type classifies the reason, e.g. kernel, library or microcode
+	Type     string   `json:"type,omitempty"`
+	Severity string   `json:"severity,omitempty"`
+	Reason   string   `json:"reason"`
+	Packages []string `json:"packages,omitempty"`
+	CVEs     []string `json:"cves,omitempty"`
+}
+
+// JoinRestartReasons returns the texts of the reasons separated by newlines
+func JoinRestartReasons(reasons []RestartReason) string {
+	texts := make([]string, 0, len(reasons))
+	for _, reason := range reasons {
+		texts = append(texts, reason.Reason)
+	}
+	return strings.Join(texts, "\n")
+}
+
+// Response is the answer of the goahead service
+type Response struct {
+	Error          string    `json:"error"`
+	Timestamp      time.Time `json:"timestamp"`
+	Goahead        bool      `json:"go_ahead"`
+	UnknownHost    bool      `json:"unknown_host"`
+	AskagainIn     string    `json:"ask_again_in"`
+	RequestID      string    `json:"request_id"`
+	FoundCluster   string    `json:"found_cluster"`
+	RequestingFqdn string    `json:"requesting_fqdn"`
+	Message        string    `json:"message"`
+	// ServiceURL is the service URL which sent the response, it is set by the Client
+	ServiceURL string `json:"-"`
+}
+
+// RestartDoneReport is sent to the goahead service on the first run after a granted restart
+type RestartDoneReport struct {
+	Fqdn           string                   `json:"fqdn"`
+	RequestID      string                   `json:"request_id"`
+	RestartReason  string                   `json:"restart_reason"`
+	RestartReasons []RestartReason          `json:"restart_reasons,omitempty"`
+	PreviousUptime string                   `json:"previous_uptime"`
+	Uptime         string                   `json:"uptime"`
+	PreviousBootID string                   `json:"previous_boot_id,omitempty"`
+	BootID         string                   `json:"boot_id,omitempty"`
+	RequestedAt    time.Time                `json:"requested_at"`
+	GrantedAt      time.Time                `json:"granted_at"`
+	HealthChecks   *PostRestartChecksResult `json:"health_checks,omitempty"`
+}
+
+// RestartAbortedReport tells the goahead service that a granted restart was aborted, because a
+// restart hook failed or a check after the go ahead stopped it, so that the service can release the
+// cluster lock
+type RestartAbortedReport struct {
+	Fqdn           string          `json:"fqdn"`
+	RequestID      string          `json:"request_id"`
+	RestartReason  string          `json:"restart_reason"`
+	RestartReasons []RestartReason `json:"restart_reasons,omitempty"`
+	// Phase is the hook phase of the failed hook, e.g. pre_restart, or the check which stopped the
+	// restart after the go ahead, i.e. maintenance_window or blackout
+	Phase      string `json:"phase"`
+	FailedHook string `json:"failed_hook"`
+	// FailedHooks lists all failed hooks if several hooks which were executed in parallel failed,
+	// FailedHook, ReturnCode and Output describe the first of them
+	FailedHooks []string  `json:"failed_hooks,omitempty"`
+	ReturnCode  int       `json:"return_code"`
+	Output      string    `json:"output"`
+	AbortedAt   time.Time `json:"aborted_at"`
+}
+
+// StatusReport tells the goahead service about a host which does not negotiate restarts, so that the
+// service can show and alert on it
+type StatusReport struct {
+	Fqdn   string `json:"fqdn"`
+	Uptime string `json:"uptime"`
+	// Status is disabled for an administratively disabled host
+	Status         string    `json:"status"`
+	DisabledReason string    `json:"disabled_reason,omitempty"`
+	DisabledBy     string    `json:"disabled_by,omitempty"`
+	DisabledAt     time.Time `json:"disabled_at,omitzero"`
+	// DisabledAge is the duration since DisabledAt
+	DisabledAge   string    `json:"disabled_age,omitempty"`
+	DisabledUntil time.Time `json:"disabled_until,omitzero"`
+	Facts         *Facts    `json:"facts,omitempty"`
+	DryRun        bool      `json:"dry_run,omitempty"`
+}
+
+// PostRestartChecksResult is the aggregated result of the health checks after a restart
+type PostRestartChecksResult struct {
+	Passed   bool               `json:"passed"`
+	Rounds   int                `json:"rounds"`
+	Duration string             `json:"duration"`
+	Checks   []PostRestartCheck `json:"checks"`
+}
+
+// PostRestartCheck is the result of the last execution of a single health check after a restart
+type PostRestartCheck struct {
+	Name       string `json:"name"`
+	Passed     bool   `json:"passed"`
+	ReturnCode int    `json:"return_code"`
+	Attempts   int    `json:"attempts"`
+	Output     string `json:"output"`
+}
+
+// Client talks to the goahead service
+type Client struct {
+	config     Config
+	httpClient *http.Client
+	endpoints  *endpoints
+	// pinned restricts the requests to a single service URL
+	pinned string
+}
+
+// New validates the config and creates a Client with the configured TLS settings
+func New(config Config) (*Client, error) {
+	if config.Debugf == nil {
+		config.Debugf = func(string) {}
+	}
+	if config.Infof == nil {
+		config.Infof = func(string) {}
+	}
+	endpoints, err := newEndpoints(config)
+	if err != nil {
+		return nil, err
+	}
+	if config.Uptime == nil {
+		config.Uptime = ReadUptime
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 5 * time.Second
+	}
+	if config.RequestDeadline <= 0 {
+		config.RequestDeadline = time.Minute
+	}
+	if config.MaxRetries == 0 {
+		config.MaxRetries = 5
+	} else if config.MaxRetries < 0 {
+		config.MaxRetries = 0
+	}
+	if config.BackoffMin <= 0 {
+		config.BackoffMin = time.Second
+	}
+	if config.BackoffMax < config.BackoffMin {
+		config.BackoffMax = 30 * time.Second
+		if config.BackoffMax < config.BackoffMin {
+			config.BackoffMax = config.BackoffMin
+		}
+	}
+
+	httpClient, err := newHttpClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{config: config, httpClient: httpClient, endpoints: endpoints}, nil
+}
+
+// WithServiceURL returns a Client which sends all requests to the given service URL only, e.g. to
+// continue a negotiation with the server that issued the request_id
+func (c *Client) WithServiceURL(serviceURL string) *Client {
+	if !strings.HasSuffix(serviceURL, "/") {
+		serviceURL = serviceURL + "/"
+	}
+	pinned := *c
+	pinned.pinned = serviceURL
+	return &pinned
+}
+
+// serviceURLs returns the service URLs in the order they should be tried
+func (c *Client) serviceURLs(ctx context.Context) ([]string, error) {
+	if len(c.pinned) > 0 {
+		return []string{c.pinned}, nil
+	}
+	return c.endpoints.order(ctx)
+}
+
+func newHttpClient(config Config) (*http.Client, error) {
+	// Get the SystemCertPool, continue with an empty pool on error
+	rootCAs, _ := x509.SystemCertPool()
+	if rootCAs == nil {
+		rootCAs = x509.NewCertPool()
+	}
+
+	if len(config.CAFile) > 0 {
+		// Read in the cert file
+		certs, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, errors.New("Failed to append " + config.CAFile + " to RootCAs Error: " + err.Error())
+		}
+
+		// Append our cert to the system pool
+		config.Debugf("Appending certificate " + config.CAFile + " to trusted CAs")
+		if ok := rootCAs.AppendCertsFromPEM(certs); !ok {
+			config.Debugf("No certs appended, using system certs only")
+		}
+	}
+
+	// Trust the augmented cert pool in our client
+	tlsConfig := &tls.Config{
+		RootCAs: rootCAs,
+	}
+
+	if len(config.CertificateFile) > 0 && len(config.PrivateKeyFile) > 0 {
+		loader := newClientCertificateLoader(config.CertificateFile, config.PrivateKeyFile, config.PrivateKeyPassphrase, config.Debugf)
+		if err := loader.load(); err != nil {
+			if config.RequireClientCertificate {
+				return nil, errors.New("ssl_require_and_verify_client_cert is enabled, but no usable client certificate could be loaded. " + err.Error())
+			}
+			config.Debugf("Continuing without client certificate. " + err.Error())
+		}
+		// the loader is also used during each handshake to pick up rotated certificates
+		tlsConfig.GetClientCertificate = loader.getClientCertificate
+	} else if config.RequireClientCertificate {
+		return nil, errors.New("ssl_require_and_verify_client_cert is enabled, but no client certificate and private key are configured")
+	}
+
+	tr := &http.Transport{TLSClientConfig: tlsConfig}
+	return &http.Client{Transport: tr}, nil
+}
+
+// Inquire asks the goahead service if this host should restart because of reasons only the service knows
+func (c *Client) Inquire(ctx context.Context) (Response, error) {
+	payload, err := c.getPayload("", "inquire", nil)
+	if err != nil {
+		return Response{}, err
+	}
+	return c.post(ctx, "v1/inquire/restart/", payload)
+}
+
+// RequestRestart asks the goahead service for the permission to restart. The requestID of the previous
+// response has to be sent with each further request of the same negotiation.
+func (c *Client) RequestRestart(ctx context.Context, restartReasons []RestartReason, requestID string) (Response, error) {
+	payload, err := c.getPayload(requestID, JoinRestartReasons(restartReasons), restartReasons)
+	if err != nil {
+		return Response{}, err
+	}
+	return c.post(ctx, "v1/request/restart/os", payload)
+}
+
+// ReportRestartDone confirms a completed restart to the goahead service
+func (c *Client) ReportRestartDone(ctx context.Context, report RestartDoneReport) (Response, error) {
+	if len(report.Fqdn) == 0 {
+		report.Fqdn = c.fqdn()
+	}
+	payload, err := json.Marshal(report)
+	if err != nil {
+		return Response{}, errors.New("Error while json.Marshal report. Error: " + err.Error())
+	}
+	c.config.Debugf("Trying to send report: " + string(payload))
+	return c.post(ctx, "v1/report/restart/done", payload)
+}
+
+// ReportRestartAborted tells the goahead service that a granted restart was aborted
+func (c *Client) ReportRestartAborted(ctx context.Context, report RestartAbortedReport) (Response, error) {
+	if len(report.Fqdn) == 0 {
+		report.Fqdn = c.fqdn()
+	}
+	payload, err := json.Marshal(report)
+	if err != nil {
+		return Response{}, errors.New("Error while json.Marshal abort report. Error: " + err.Error())
+	}
+	c.config.Debugf("Trying to send abort report: " + string(payload))
+	return c.post(ctx, "v1/report/restart/aborted", payload)
+}
+
+// ReportStatus sends the status of a host which does not negotiate restarts to the goahead service
+func (c *Client) ReportStatus(ctx context.Context, report StatusReport) (Response, error) {
+	if len(report.Fqdn) == 0 {
+		report.Fqdn = c.fqdn()
+	}
+	if len(report.Uptime) == 0 {
+		uptime, err := c.config.Uptime()
+		if err != nil {
+			return Response{}, err
+		}
+		report.Uptime = uptime.String()
+	}
+	if report.Facts == nil && c.config.Facts != nil {
+		report.Facts = c.config.Facts()
+	}
+	report.DryRun = c.config.DryRun
+	payload, err := json.Marshal(report)
+	if err != nil {
+		return Response{}, errors.New("Error while json.Marshal status report. Error: " + err.Error())
+	}
+	c.config.Debugf("Trying to send status report: " + string(payload))
+	return c.post(ctx, "v1/report/status", payload)
+}
+
+func (c *Client) fqdn() string {
+	if len(c.config.Fqdn) > 0 {
+		return c.config.Fqdn
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		c.config.Debugf("Error while getting hostname Error: " + err.Error())
+	}
+	return hostname
+}
+
+func (c *Client) getPayload(rid string, restartReason string, restartReasons []RestartReason) ([]byte, error) {
+	uptime, err := c.config.Uptime()
+	if err != nil {
+		return nil, err
+	}
+	req := Request{
+		Fqdn:           c.fqdn(),
+		Uptime:         uptime.String(),
+		RequestID:      rid,
+		RestartReason:  restartReason,
+		RestartReasons: restartReasons,
+	}
+	req.DryRun = c.config.DryRun
+	if c.config.Facts != nil {
+		req.Facts = c.config.Facts()
+	}
+
+	reqBytes, err := json.Marshal(req)
+	if err != nil {
+		return nil, errors.New("Error while json.Marshal request. Error: " + err.Error())
+	}
+
+	c.config.Debugf("Trying to send payload: " + string(reqBytes))
+
+	return reqBytes, nil
+}
+
+// ReadUptime returns the uptime of the host from /proc/uptime with a precision of seconds
+func ReadUptime() (time.Duration, error) {
+	dat, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0, errors.New("Error while trying to open /proc/uptime. Error: " + err.Error())
+	}
+	times := strings.Fields(string(dat))
+	if len(times) == 0 {
+		return 0, errors.New("Error while trying to parse /proc/uptime: " + string(dat))
+	}
+	uptimeSeconds := strings.Split(times[0], ".")[0]
+	uptime, err := time.ParseDuration(uptimeSeconds + "s")
+	if err != nil {
+		return 0, errors.New("Error while trying to parse uptime to Duration. Error: " + err.Error())
+	}
+	return uptime, nil
+}
@@ -0,0 +1,411 @@
+package goahead
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func spinUpFakeService(t *testing.T, handler func(path string, request Request) string) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request Request
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("Error while reading request body: %s", err)
+		}
+		fmt.Fprint(w, handler(r.URL.Path, request))
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func fakeUptime() (time.Duration, error) {
+	return 83836 * time.Second, nil
+}
+
+func TestRequestRestart(t *testing.T) {
+	var received Request
+	ts := spinUpFakeService(t, func(path string, request Request) string {
+		if path != "/v1/request/restart/os" {
+			t.Errorf("unexpected request path %s", path)
+		}
+		received = request
+		return `{"go_ahead":true,"ask_again_in":"20s","request_id":"sqEALyco","found_cluster":"foobar-server","message":"OK"}`
+	})
+
+	c, err := New(Config{ServiceURL: ts.URL, Fqdn: "foobar-server-aa02.domain.tld", Uptime: fakeUptime})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reasons := []RestartReason{{Source: "kernel", Reason: "kernel update"}, {Source: "reboot_required", Reason: "/var/run/reboot-required exists"}}
+	response, err := c.RequestRestart(context.Background(), reasons, "sqEALyco")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !response.Goahead || response.RequestID != "sqEALyco" || response.FoundCluster != "foobar-server" {
+		t.Errorf("unexpected response %+v", response)
+	}
+	expected := Request{Fqdn: "foobar-server-aa02.domain.tld", Uptime: "23h17m16s", RequestID: "sqEALyco", RestartReason: "kernel update\n/var/run/reboot-required exists", RestartReasons: reasons}
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("service received %+v, but we expected %+v", received, expected)
+	}
+}
+
+func TestInquire(t *testing.T) {
+	ts := spinUpFakeService(t, func(path string, request Request) string {
+		if path != "/v1/inquire/restart/" || request.RestartReason != "inquire" {
+			t.Errorf("unexpected request %+v to %s", request, path)
+		}
+		return `{"go_ahead":false,"message":"YesInquireToRestart kernel too old"}`
+	})
+
+	c, err := New(Config{ServiceURL: ts.URL, Uptime: fakeUptime})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := c.Inquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(response.Message, "YesInquireToRestart") {
+		t.Errorf("unexpected response %+v", response)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	ts := spinUpFakeService(t, func(path string, request Request) string {
+		return `{"go_ahead":false,"message":"NoInquireToRestart"}`
+	})
+
+	var debugMessages []string
+	c, err := New(Config{ServiceURL: ts.URL, Uptime: fakeUptime, Debugf: func(s string) { debugMessages = append(debugMessages, s) }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Inquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(debugMessages) == 0 || !strings.Contains(strings.Join(debugMessages, "\n"), "Received valid response from "+ts.URL) {
+		t.Errorf("Debugf received %q, but we expected the valid response to be logged", debugMessages)
+	}
+}
+
+func TestReportStatus(t *testing.T) {
+	var received StatusReport
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/report/status" {
+			t.Errorf("unexpected request path %s", r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Errorf("Error while reading request body: %s", err)
+		}
+		fmt.Fprint(w, `{"message":"OK"}`)
+	}))
+	defer ts.Close()
+
+	c, err := New(Config{ServiceURL: ts.URL, Fqdn: "foobar-server-aa02.domain.tld", Uptime: fakeUptime})
+	if err != nil {
+		t.Fatal(err)
+	}
+	disabledAt := time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC)
+	report := StatusReport{Status: "disabled", DisabledReason: "database migration", DisabledBy: "alice", DisabledAt: disabledAt, DisabledAge: "72h0m0s"}
+	if _, err := c.ReportStatus(context.Background(), report); err != nil {
+		t.Fatal(err)
+	}
+	report.Fqdn = "foobar-server-aa02.domain.tld"
+	report.Uptime = "23h17m16s"
+	if !reflect.DeepEqual(received, report) {
+		t.Errorf("service received %+v, but we expected %+v", received, report)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	ts := spinUpFakeService(t, func(path string, request Request) string {
+		if path == "/v1/inquire/restart/" {
+			return `{"error":"Could not write request file"}`
+		}
+		return `<html>502 Bad Gateway</html>`
+	})
+
+	c, err := New(Config{ServiceURL: ts.URL, Uptime: fakeUptime, BackoffMin: time.Millisecond, BackoffMax: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := c.Inquire(context.Background())
+	if err == nil || response.Error != "Could not write request file" {
+		t.Errorf("an error field in the response should be returned as error, got response %+v and error %v", response, err)
+	}
+	if _, err := c.RequestRestart(context.Background(), nil, ""); err == nil || !strings.HasPrefix(err.Error(), "Could not parse JSON response") {
+		t.Errorf("an unparsable response should be returned as error, got %v", err)
+	}
+
+	ts.Close()
+	_, err = c.RequestRestart(context.Background(), nil, "")
+	if err == nil || !strings.HasPrefix(err.Error(), "Error while issuing request") {
+		t.Errorf("an unreachable service should be returned as error, got %v", err)
+	}
+	var requestErr *RequestError
+	if !errors.As(err, &requestErr) || !requestErr.Retryable || requestErr.Attempts != 6 {
+		t.Errorf("an unreachable service should be retried 5 times, got %#v", err)
+	}
+
+	if _, err := New(Config{ServiceURL: "not a url"}); err == nil {
+		t.Errorf("New() should fail with an invalid service URL")
+	}
+}
+
+func spinUpFlakyService(t *testing.T, handler func(attempt int, w http.ResponseWriter)) (*httptest.Server, *int32) {
+	var attempts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler(int(atomic.AddInt32(&attempts, 1)), w)
+	}))
+	t.Cleanup(ts.Close)
+	return ts, &attempts
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name             string
+		handler          func(attempt int, w http.ResponseWriter)
+		config           Config
+		expectedError    string
+		expectedAttempts int32
+		minDuration      time.Duration
+	}{
+		{
+			name: "service unavailable twice",
+			handler: func(attempt int, w http.ResponseWriter) {
+				if attempt < 3 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				fmt.Fprint(w, `{"go_ahead":true}`)
+			},
+			expectedAttempts: 3,
+		},
+		{
+			name: "too many requests with Retry-After",
+			handler: func(attempt int, w http.ResponseWriter) {
+				if attempt == 1 {
+					w.Header().Set("Retry-After", "1")
+					w.WriteHeader(http.StatusTooManyRequests)
+					return
+				}
+				fmt.Fprint(w, `{"go_ahead":true}`)
+			},
+			expectedAttempts: 2,
+			minDuration:      time.Second,
+		},
+		{
+			name: "bad request is not retried",
+			handler: func(attempt int, w http.ResponseWriter) {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error":"missing fqdn"}`)
+			},
+			expectedError:    "Recieved error: missing fqdn",
+			expectedAttempts: 1,
+		},
+		{
+			name: "giving up after max retries",
+			handler: func(attempt int, w http.ResponseWriter) {
+				w.WriteHeader(http.StatusBadGateway)
+			},
+			config:           Config{MaxRetries: 2},
+			expectedError:    "Received HTTP status 502 Bad Gateway (giving up",
+			expectedAttempts: 3,
+		},
+		{
+			name: "retries disabled",
+			handler: func(attempt int, w http.ResponseWriter) {
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			config:           Config{MaxRetries: -1},
+			expectedError:    "Received HTTP status 500 Internal Server Error",
+			expectedAttempts: 1,
+		},
+		{
+			name: "hanging service",
+			handler: func(attempt int, w http.ResponseWriter) {
+				if attempt == 1 {
+					time.Sleep(500 * time.Millisecond)
+				}
+				fmt.Fprint(w, `{"go_ahead":true}`)
+			},
+			config:           Config{Timeout: 100 * time.Millisecond},
+			expectedAttempts: 2,
+		},
+		{
+			name: "request deadline",
+			handler: func(attempt int, w http.ResponseWriter) {
+				time.Sleep(500 * time.Millisecond)
+			},
+			config:           Config{Timeout: 100 * time.Millisecond, RequestDeadline: 250 * time.Millisecond, BackoffMin: time.Second},
+			expectedError:    "Error while issuing request",
+			expectedAttempts: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ts, attempts := spinUpFlakyService(t, test.handler)
+			config := test.config
+			config.ServiceURL = ts.URL
+			config.Uptime = fakeUptime
+			if config.BackoffMin == 0 {
+				config.BackoffMin = 10 * time.Millisecond
+				config.BackoffMax = 20 * time.Millisecond
+			}
+			c, err := New(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			start := time.Now()
+			response, err := c.RequestRestart(context.Background(), nil, "")
+			duration := time.Since(start)
+			if len(test.expectedError) == 0 {
+				if err != nil || !response.Goahead {
+					t.Errorf("expected a granted restart, got response %+v and error %v", response, err)
+				}
+			} else if err == nil || !strings.HasPrefix(err.Error(), test.expectedError) {
+				t.Errorf("expected error starting with '%s', got %v", test.expectedError, err)
+			}
+			if got := atomic.LoadInt32(attempts); got != test.expectedAttempts {
+				t.Errorf("service received %d requests, but we expected %d", got, test.expectedAttempts)
+			}
+			if duration < test.minDuration {
+				t.Errorf("request took %s, but should have waited at least %s", duration, test.minDuration)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if got := parseRetryAfter("120"); got != 2*time.Minute {
+		t.Errorf("parseRetryAfter(120) returned %s, but we expected 2m0s", got)
+	}
+	date := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(date); got < 59*time.Minute || got > time.Hour {
+		t.Errorf("parseRetryAfter(%s) returned %s, but we expected about 1h", date, got)
+	}
+	for _, retryAfter := range []string{"", "-1", "soon", strconv.Itoa(0)} {
+		if got := parseRetryAfter(retryAfter); got != 0 {
+			t.Errorf("parseRetryAfter(%s) returned %s, but we expected 0", retryAfter, got)
+		}
+	}
+}
+
+func TestFailover(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	unavailable, unavailableAttempts := spinUpFlakyService(t, func(attempt int, w http.ResponseWriter) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	var answered []string
+	var mutex sync.Mutex
+	spinUpAnsweringService := func(name string) *httptest.Server {
+		ts, _ := spinUpFlakyService(t, func(attempt int, w http.ResponseWriter) {
+			mutex.Lock()
+			answered = append(answered, name)
+			mutex.Unlock()
+			fmt.Fprint(w, `{"go_ahead":false,"request_id":"`+name+`"}`)
+		})
+		return ts
+	}
+	first := spinUpAnsweringService("first")
+	second := spinUpAnsweringService("second")
+
+	c, err := New(Config{
+		ServiceURL:  down.URL,
+		ServiceURLs: []string{unavailable.URL, first.URL, second.URL},
+		Uptime:      fakeUptime,
+		MaxRetries:  -1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := c.RequestRestart(context.Background(), nil, "")
+	if err != nil || response.ServiceURL != first.URL+"/" {
+		t.Fatalf("expected a response from %s, got response %+v and error %v", first.URL, response, err)
+	}
+	if got := atomic.LoadInt32(unavailableAttempts); got != 1 {
+		t.Errorf("unavailable service received %d requests, but we expected 1", got)
+	}
+
+	// the service URL which answered last is tried first
+	if response, err := c.RequestRestart(context.Background(), nil, ""); err != nil || response.ServiceURL != first.URL+"/" {
+		t.Errorf("expected a response from %s, got response %+v and error %v", first.URL, response, err)
+	}
+	if got := atomic.LoadInt32(unavailableAttempts); got != 1 {
+		t.Errorf("unavailable service received %d requests, but we expected 1", got)
+	}
+
+	// a pinned client only uses the given service URL
+	if response, err := c.WithServiceURL(second.URL).RequestRestart(context.Background(), nil, "second"); err != nil || response.ServiceURL != second.URL+"/" {
+		t.Errorf("expected a response from %s, got response %+v and error %v", second.URL, response, err)
+	}
+	if _, err := c.WithServiceURL(down.URL).RequestRestart(context.Background(), nil, ""); err == nil {
+		t.Errorf("a pinned client should not fail over to other service URLs")
+	}
+	mutex.Lock()
+	if !reflect.DeepEqual(answered, []string{"first", "first", "second"}) {
+		t.Errorf("services answered in order %q, but we expected first, first, second", answered)
+	}
+	mutex.Unlock()
+
+	// random order still sticks to the service URL which answered
+	c, err = New(Config{ServiceURLs: []string{down.URL, first.URL, second.URL}, ShuffleServiceURLs: true, Uptime: fakeUptime, MaxRetries: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err = c.Inquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if next, err := c.Inquire(context.Background()); err != nil || next.ServiceURL != response.ServiceURL {
+			t.Errorf("expected a response from %s, got response %+v and error %v", response.ServiceURL, next, err)
+		}
+	}
+
+	// a service URL which responded with 503 is not tried first by the next request
+	recovering, _ := spinUpFlakyService(t, func(attempt int, w http.ResponseWriter) {
+		if attempt == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"go_ahead":false}`)
+	})
+	atomic.StoreInt32(unavailableAttempts, 0)
+	c, err = New(Config{ServiceURLs: []string{recovering.URL, unavailable.URL}, Uptime: fakeUptime, MaxRetries: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Inquire(context.Background()); err == nil {
+		t.Errorf("expected an error, because all service URLs responded with 503")
+	}
+	if response, err := c.Inquire(context.Background()); err != nil || response.ServiceURL != recovering.URL+"/" {
+		t.Errorf("expected a response from %s, got response %+v and error %v", recovering.URL, response, err)
+	}
+	if got := atomic.LoadInt32(unavailableAttempts); got != 1 {
+		t.Errorf("unavailable service received %d requests, but we expected 1", got)
+	}
+
+	// all service URLs down
+	c, err = New(Config{ServiceURLs: []string{down.URL, unavailable.URL}, Uptime: fakeUptime, MaxRetries: 1, BackoffMin: time.Millisecond, BackoffMax: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Inquire(context.Background()); err == nil || !strings.HasPrefix(err.Error(), "Received HTTP status 503") {
+		t.Errorf("expected the error of the last service URL, got %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+package goahead
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// endpoints are the service URLs of the goahead service, the one which answered last is tried first
+type endpoints struct {
+	urls    []string
+	shuffle bool
+	debugf  func(string)
+	infof   func(string)
+
+	// srv is the name of a DNS SRV record, which is resolved before each request
+	srv       string
+	srvScheme string
+	resolver  *net.Resolver
+
+	mutex sync.Mutex
+	// discovered are the service URLs of the last successful SRV lookup
+	discovered []string
+	lastGood   string
+}
+
+// newEndpoints validates the service URLs and makes sure that each one ends with a slash
+func newEndpoints(config Config) (*endpoints, error) {
+	e := &endpoints{shuffle: config.ShuffleServiceURLs, debugf: config.Debugf, infof: config.Infof, srv: config.ServiceSRV, srvScheme: config.ServiceSRVScheme, resolver: net.DefaultResolver}
+	if len(e.srvScheme) == 0 {
+		e.srvScheme = "https"
+	}
+	if len(config.ServiceSRVResolver) > 0 {
+		resolverAddress := config.ServiceSRVResolver
+		if _, _, err := net.SplitHostPort(resolverAddress); err != nil {
+			resolverAddress = net.JoinHostPort(resolverAddress, "53")
+		}
+		e.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, resolverAddress)
+			},
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, serviceURL := range append([]string{config.ServiceURL}, config.ServiceURLs...) {
+		if len(serviceURL) == 0 {
+			continue
+		}
+		if _, err := url.ParseRequestURI(serviceURL); err != nil {
+			return nil, errors.New("Failed to parse/validate service URL " + serviceURL + " Error: " + err.Error())
+		}
+		if !strings.HasSuffix(serviceURL, "/") {
+			serviceURL = serviceURL + "/"
+		}
+		if !seen[serviceURL] {
+			seen[serviceURL] = true
+			e.urls = append(e.urls, serviceURL)
+		}
+	}
+	if len(e.urls) == 0 && len(e.srv) == 0 {
+		return nil, errors.New("missing service URL")
+	}
+	return e, nil
+}
+
+// order returns the service URLs in the order they should be tried: the last one that answered
+// first, followed by the ones found via SRV record in the order of their priority and weight and
+// the configured ones in configured or random order
+func (e *endpoints) order(ctx context.Context) ([]string, error) {
+	var candidates []string
+	if len(e.srv) > 0 {
+		discovered, err := e.lookupSRV(ctx)
+		if err != nil {
+			if len(e.urls) == 0 && len(discovered) == 0 {
+				return nil, err
+			}
+			e.infof(err.Error() + " Using the previously found and configured service URLs")
+		}
+		candidates = append(candidates, discovered...)
+	}
+	others := make([]string, len(e.urls))
+	copy(others, e.urls)
+	if e.shuffle {
+		rand.Shuffle(len(others), func(i, j int) { others[i], others[j] = others[j], others[i] })
+	}
+	candidates = append(candidates, others...)
+
+	e.mutex.Lock()
+	lastGood := e.lastGood
+	e.mutex.Unlock()
+
+	ordered := make([]string, 0, len(candidates))
+	seen := make(map[string]bool)
+	for _, u := range candidates {
+		if seen[u] {
+			continue
+		}
+		seen[u] = true
+		if u == lastGood {
+			ordered = append([]string{u}, ordered...)
+		} else {
+			ordered = append(ordered, u)
+		}
+	}
+	return ordered, nil
+}
+
+// lookupSRV resolves the SRV record to service URLs, which are sorted by priority and randomized by
+// weight. If the lookup fails the service URLs of the last successful lookup are returned together
+// with the error.
+func (e *endpoints) lookupSRV(ctx context.Context) ([]string, error) {
+	_, records, err := e.resolver.LookupSRV(ctx, "", "", e.srv)
+	var discovered []string
+	for _, record := range records {
+		target := strings.TrimSuffix(record.Target, ".")
+		// a target of "." means that the service is not available at this domain
+		if len(target) == 0 {
+			continue
+		}
+		discovered = append(discovered, e.srvScheme+"://"+net.JoinHostPort(target, strconv.Itoa(int(record.Port)))+"/")
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if err != nil {
+		return e.discovered, errors.New("Failed to look up SRV record " + e.srv + " Error: " + err.Error())
+	}
+	if len(discovered) == 0 {
+		return e.discovered, errors.New("SRV record " + e.srv + " does not contain any targets")
+	}
+	e.debugf("Found service URLs via SRV record " + e.srv + ": " + strings.Join(discovered, " "))
+	e.discovered = discovered
+	return discovered, nil
+}
+
+// answered remembers the service URL which answered last
+func (e *endpoints) answered(serviceURL string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.lastGood = serviceURL
+}
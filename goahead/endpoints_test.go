@@ -0,0 +1,147 @@
+package goahead
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// spinUpFakeDNS starts a minimal DNS server on UDP which answers SRV queries with the given records
+// and returns its address
+func spinUpFakeDNS(t *testing.T, records map[string][]net.SRV) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	var mutex sync.Mutex
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := buf[:n]
+			if n < 12 {
+				continue
+			}
+			// parse the name of the first question
+			var labels []string
+			offset := 12
+			for offset < n && query[offset] != 0 {
+				length := int(query[offset])
+				labels = append(labels, string(query[offset+1:offset+1+length]))
+				offset += 1 + length
+			}
+			offset += 5 // terminating zero byte, QTYPE and QCLASS
+			name := strings.ToLower(strings.Join(labels, ".")) + "."
+			qtype := binary.BigEndian.Uint16(query[offset-4 : offset-2])
+
+			mutex.Lock()
+			answers, found := records[name]
+			mutex.Unlock()
+			if qtype != 33 {
+				answers = nil
+			}
+
+			response := append([]byte{}, query[:2]...)
+			flags := uint16(0x8180)
+			if !found {
+				flags |= 3 // NXDOMAIN
+			}
+			response = binary.BigEndian.AppendUint16(response, flags)
+			response = binary.BigEndian.AppendUint16(response, 1)
+			response = binary.BigEndian.AppendUint16(response, uint16(len(answers)))
+			response = binary.BigEndian.AppendUint16(response, 0)
+			response = binary.BigEndian.AppendUint16(response, 0)
+			response = append(response, query[12:offset]...)
+			for _, answer := range answers {
+				var target []byte
+				for _, label := range strings.Split(strings.TrimSuffix(answer.Target, "."), ".") {
+					target = append(target, byte(len(label)))
+					target = append(target, label...)
+				}
+				target = append(target, 0)
+				response = append(response, 0xc0, 12) // pointer to the question name
+				response = binary.BigEndian.AppendUint16(response, 33)
+				response = binary.BigEndian.AppendUint16(response, 1)
+				response = binary.BigEndian.AppendUint32(response, 60)
+				response = binary.BigEndian.AppendUint16(response, uint16(6+len(target)))
+				response = binary.BigEndian.AppendUint16(response, answer.Priority)
+				response = binary.BigEndian.AppendUint16(response, answer.Weight)
+				response = binary.BigEndian.AppendUint16(response, answer.Port)
+				response = append(response, target...)
+			}
+			conn.WriteTo(response, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func srvRecord(ts *httptest.Server, priority uint16) net.SRV {
+	return net.SRV{Target: "localhost.", Port: uint16(ts.Listener.Addr().(*net.TCPAddr).Port), Priority: priority, Weight: 10}
+}
+
+// srvURL returns the service URL of the fake service when found via SRV record
+func srvURL(ts *httptest.Server) string {
+	return "http://localhost:" + strconv.Itoa(ts.Listener.Addr().(*net.TCPAddr).Port) + "/"
+}
+
+func TestServiceSRV(t *testing.T) {
+	primary := spinUpFakeService(t, func(path string, request Request) string {
+		return `{"message":"primary"}`
+	})
+	secondary := spinUpFakeService(t, func(path string, request Request) string {
+		return `{"message":"secondary"}`
+	})
+	resolver := spinUpFakeDNS(t, map[string][]net.SRV{
+		"_goahead._tcp.domain.tld.": {srvRecord(secondary, 20), srvRecord(primary, 10)},
+	})
+
+	c, err := New(Config{ServiceSRV: "_goahead._tcp.domain.tld", ServiceSRVScheme: "http", ServiceSRVResolver: resolver, Uptime: fakeUptime, MaxRetries: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serviceURLs, err := c.serviceURLs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(serviceURLs) != 2 || serviceURLs[0] != srvURL(primary) || serviceURLs[1] != srvURL(secondary) {
+		t.Errorf("SRV record resolved to %q, but we expected %s before %s", serviceURLs, srvURL(primary), srvURL(secondary))
+	}
+	if response, err := c.Inquire(context.Background()); err != nil || response.Message != "primary" {
+		t.Errorf("expected a response from the target with the lowest priority, got response %+v and error %v", response, err)
+	}
+
+	primary.Close()
+	if response, err := c.Inquire(context.Background()); err != nil || response.Message != "secondary" {
+		t.Errorf("expected a response from the remaining target, got response %+v and error %v", response, err)
+	}
+
+	// the configured service URLs are used if the SRV record could not be resolved
+	fallback := spinUpFakeService(t, func(path string, request Request) string {
+		return `{"message":"fallback"}`
+	})
+	c, err = New(Config{ServiceSRV: "_missing._tcp.domain.tld", ServiceSRVResolver: resolver, ServiceURL: fallback.URL, Uptime: fakeUptime, MaxRetries: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response, err := c.Inquire(context.Background()); err != nil || response.Message != "fallback" {
+		t.Errorf("expected a response from the configured service URL, got response %+v and error %v", response, err)
+	}
+
+	c, err = New(Config{ServiceSRV: "_missing._tcp.domain.tld", ServiceSRVResolver: resolver, Uptime: fakeUptime, MaxRetries: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Inquire(context.Background()); err == nil || !strings.HasPrefix(err.Error(), "Failed to look up SRV record _missing._tcp.domain.tld") {
+		t.Errorf("expected an error for the missing SRV record, got %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+package goahead
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RequestError is returned if a request to the goahead service failed
+type RequestError struct {
+	URL string
+	// StatusCode of the last response, 0 if no response was received
+	StatusCode int
+	// Retryable is true for connection errors and 5xx/429 responses
+	Retryable bool
+	Attempts  int
+	Err       error
+}
+
+func (e *RequestError) Error() string {
+	if e.Attempts > 1 {
+		return e.Err.Error() + " (giving up on " + e.URL + " after " + strconv.Itoa(e.Attempts) + " attempts)"
+	}
+	return e.Err.Error()
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// post sends the payload to the given path of the goahead service and parses its response.
+// The service URLs are tried one after another until one of them answers. If none of them answered
+// or the service responded with 5xx/429, the request is retried with exponential backoff until
+// MaxRetries or RequestDeadline is reached. An error field in the response is returned as error
+// together with the response.
+func (c *Client) post(ctx context.Context, path string, payload []byte) (Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.config.RequestDeadline)
+	defer cancel()
+
+	serviceURLs, err := c.serviceURLs(ctx)
+	if err != nil {
+		return Response{}, err
+	}
+	for attempt := 1; ; attempt++ {
+		var response Response
+		var retryAfter time.Duration
+		var err *RequestError
+		for i, serviceURL := range serviceURLs {
+			response, retryAfter, err = c.postOnce(ctx, serviceURL+path, payload)
+			if err == nil || (!err.Retryable && err.StatusCode != 0) {
+				// the service answered, even if it was with an error, but not if it is unavailable (5xx/429)
+				c.endpoints.answered(serviceURL)
+				response.ServiceURL = serviceURL
+			}
+			if err == nil {
+				return response, nil
+			}
+			err.Attempts = attempt
+			if !err.Retryable {
+				c.config.Debugf("Fatal error, not retrying request to " + err.URL + ": " + err.Err.Error())
+				return response, err
+			}
+			if ctx.Err() != nil {
+				return response, err
+			}
+			if i < len(serviceURLs)-1 {
+				c.config.Infof("Retryable error, trying next service URL. " + err.Err.Error())
+			}
+		}
+		if attempt > c.config.MaxRetries {
+			return response, err
+		}
+
+		wait := c.backoff(attempt)
+		if retryAfter > 0 {
+			wait = retryAfter
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			c.config.Infof("Retryable error, but not enough time left to retry before the request deadline. " + err.Err.Error())
+			return response, err
+		}
+		c.config.Infof("Retryable error during attempt " + strconv.Itoa(attempt) + " of " + strconv.Itoa(c.config.MaxRetries+1) + ", retrying in " + wait.Round(time.Millisecond).String() + ". " + err.Err.Error())
+		select {
+		case <-ctx.Done():
+			return response, err
+		case <-time.After(wait):
+		}
+	}
+}
+
+// postOnce sends a single request limited by Timeout and returns the Retry-After duration of the response
+func (c *Client) postOnce(ctx context.Context, url string, payload []byte) (Response, time.Duration, *RequestError) {
+	var response Response
+	ctx, cancel := context.WithTimeout(ctx, c.config.Timeout)
+	defer cancel()
+
+	c.config.Debugf("sending HTTP request " + url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return response, 0, &RequestError{URL: url, Err: errors.New("Error while creating request: " + err.Error())}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return response, 0, &RequestError{URL: url, Retryable: true, Err: errors.New("Error while issuing request: " + err.Error())}
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return response, 0, &RequestError{URL: url, StatusCode: resp.StatusCode, Retryable: true, Err: errors.New("Error while reading response body: " + err.Error())}
+	}
+	c.config.Debugf("Received response: " + string(body))
+
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		return response, parseRetryAfter(resp.Header.Get("Retry-After")), &RequestError{URL: url, StatusCode: resp.StatusCode, Retryable: true, Err: errors.New("Received HTTP status " + resp.Status)}
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return response, 0, &RequestError{URL: url, StatusCode: resp.StatusCode, Err: errors.New("Could not parse JSON response with HTTP status " + resp.Status + ": " + string(body) + " Error: " + err.Error())}
+	}
+	if len(response.Error) > 0 {
+		return response, 0, &RequestError{URL: url, StatusCode: resp.StatusCode, Err: errors.New("Recieved error: " + response.Error)}
+	}
+	c.config.Debugf("Received valid response from " + url)
+	return response, 0, nil
+}
+
+// backoff returns the exponential backoff for the given attempt with a random jitter of up to 50%
+func (c *Client) backoff(attempt int) time.Duration {
+	backoff := c.config.BackoffMin
+	for i := 1; i < attempt && backoff < c.config.BackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > c.config.BackoffMax {
+		backoff = c.config.BackoffMax
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// parseRetryAfter returns the duration of a Retry-After header given in seconds or as HTTP date
+func parseRetryAfter(retryAfter string) time.Duration {
+	if len(retryAfter) == 0 {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(retryAfter); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
@@ -0,0 +1,269 @@
+package goahead
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"hash"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC     = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+)
+
+// clientCertificateLoader holds the client certificate and private key used for mutual TLS
+// and reloads them whenever one of the files changes on disk
+type clientCertificateLoader struct {
+	certificateFile string
+	privateKeyFile  string
+	passphrase      string
+	debugf          func(string)
+
+	mu          sync.Mutex
+	certificate *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+func newClientCertificateLoader(certificateFile string, privateKeyFile string, passphrase string, debugf func(string)) *clientCertificateLoader {
+	return &clientCertificateLoader{
+		certificateFile: certificateFile,
+		privateKeyFile:  privateKeyFile,
+		passphrase:      passphrase,
+		debugf:          debugf,
+	}
+}
+
+// load (re-)reads the certificate and private key files if they changed since the last successful load
+func (l *clientCertificateLoader) load() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	certInfo, err := os.Stat(l.certificateFile)
+	if err != nil {
+		return errors.New("Failed to stat ssl_certificate_file " + l.certificateFile + " Error: " + err.Error())
+	}
+	keyInfo, err := os.Stat(l.privateKeyFile)
+	if err != nil {
+		return errors.New("Failed to stat ssl_private_key " + l.privateKeyFile + " Error: " + err.Error())
+	}
+	if l.certificate != nil && certInfo.ModTime().Equal(l.certModTime) && keyInfo.ModTime().Equal(l.keyModTime) {
+		return nil
+	}
+
+	l.debugf("Loading client certificate " + l.certificateFile + " with private key " + l.privateKeyFile)
+	certificate, err := loadX509KeyPair(l.certificateFile, l.privateKeyFile, l.passphrase)
+	if err != nil {
+		return err
+	}
+	l.certificate = certificate
+	l.certModTime = certInfo.ModTime()
+	l.keyModTime = keyInfo.ModTime()
+	return nil
+}
+
+// getClientCertificate is used as tls.Config.GetClientCertificate and picks up rotated files
+// before each handshake. If the rotated files can not be loaded the previous pair is kept.
+func (l *clientCertificateLoader) getClientCertificate(_ *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	if err := l.load(); err != nil {
+		l.debugf("Keeping previously loaded client certificate. " + err.Error())
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.certificate == nil {
+		// sending no certificate lets the server decide whether to reject the handshake
+		return &tls.Certificate{}, nil
+	}
+	return l.certificate, nil
+}
+
+// loadX509KeyPair reads a PEM encoded certificate (chain) and a PKCS#1, PKCS#8 or EC private key,
+// which can be encrypted either with the legacy PEM encryption or as PKCS#8 PBES2
+func loadX509KeyPair(certificateFile string, privateKeyFile string, passphrase string) (*tls.Certificate, error) {
+	certPEM, err := os.ReadFile(certificateFile)
+	if err != nil {
+		return nil, errors.New("Failed to read ssl_certificate_file " + certificateFile + " Error: " + err.Error())
+	}
+	keyPEM, err := os.ReadFile(privateKeyFile)
+	if err != nil {
+		return nil, errors.New("Failed to read ssl_private_key " + privateKeyFile + " Error: " + err.Error())
+	}
+
+	key, err := parsePrivateKeyPEM(keyPEM, passphrase)
+	if err != nil {
+		return nil, errors.New("Failed to parse ssl_private_key " + privateKeyFile + " Error: " + err.Error())
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, errors.New("Failed to encode ssl_private_key " + privateKeyFile + " Error: " + err.Error())
+	}
+
+	certificate, err := tls.X509KeyPair(certPEM, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+	if err != nil {
+		return nil, errors.New("Failed to use ssl_certificate_file " + certificateFile + " with ssl_private_key " + privateKeyFile + " Error: " + err.Error())
+	}
+	return &certificate, nil
+}
+
+// parsePrivateKeyPEM returns the first private key found in the given PEM data
+func parsePrivateKeyPEM(data []byte, passphrase string) (crypto.PrivateKey, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no PEM encoded private key found")
+		}
+
+		der := block.Bytes
+		blockType := block.Type
+		if blockType == "ENCRYPTED PRIVATE KEY" {
+			if len(passphrase) == 0 {
+				return nil, errors.New("private key is encrypted, but no ssl_private_key_passphrase is configured")
+			}
+			var err error
+			der, err = decryptPKCS8(der, []byte(passphrase))
+			if err != nil {
+				return nil, err
+			}
+			blockType = "PRIVATE KEY"
+		} else if x509.IsEncryptedPEMBlock(block) {
+			if len(passphrase) == 0 {
+				return nil, errors.New("private key is encrypted, but no ssl_private_key_passphrase is configured")
+			}
+			var err error
+			der, err = x509.DecryptPEMBlock(block, []byte(passphrase))
+			if err != nil {
+				return nil, errors.New("failed to decrypt private key: " + err.Error())
+			}
+		}
+
+		switch blockType {
+		case "RSA PRIVATE KEY":
+			return x509.ParsePKCS1PrivateKey(der)
+		case "EC PRIVATE KEY":
+			return x509.ParseECPrivateKey(der)
+		case "PRIVATE KEY":
+			return x509.ParsePKCS8PrivateKey(der)
+		}
+	}
+}
+
+type pkcs8AlgorithmIdentifier struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+type encryptedPrivateKeyInfo struct {
+	EncryptionAlgorithm pkcs8AlgorithmIdentifier
+	EncryptedData       []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkcs8AlgorithmIdentifier
+	EncryptionScheme  pkcs8AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkcs8AlgorithmIdentifier `asn1:"optional"`
+}
+
+// decryptPKCS8 decrypts a PBES2 (PBKDF2 + AES/3DES-CBC) encrypted PKCS#8 private key
+// as created by `openssl pkcs8 -topk8 -v2 aes-256-cbc`
+func decryptPKCS8(der []byte, passphrase []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, errors.New("failed to parse encrypted PKCS#8 private key: " + err.Error())
+	}
+	if !info.EncryptionAlgorithm.Algorithm.Equal(oidPBES2) {
+		return nil, errors.New("unsupported encrypted PKCS#8 algorithm " + info.EncryptionAlgorithm.Algorithm.String() + ", only PBES2 is supported")
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.EncryptionAlgorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, errors.New("failed to parse PBES2 parameters: " + err.Error())
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, errors.New("unsupported PBES2 key derivation function " + params.KeyDerivationFunc.Algorithm.String())
+	}
+	var kdfParams pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdfParams); err != nil {
+		return nil, errors.New("failed to parse PBKDF2 parameters: " + err.Error())
+	}
+
+	var prf func() hash.Hash
+	switch {
+	case len(kdfParams.PRF.Algorithm) == 0, kdfParams.PRF.Algorithm.Equal(oidHMACWithSHA1):
+		prf = sha1.New
+	case kdfParams.PRF.Algorithm.Equal(oidHMACWithSHA256):
+		prf = sha256.New
+	case kdfParams.PRF.Algorithm.Equal(oidHMACWithSHA512):
+		prf = sha512.New
+	default:
+		return nil, errors.New("unsupported PBKDF2 pseudo random function " + kdfParams.PRF.Algorithm.String())
+	}
+
+	var keyLength int
+	var newCipher func([]byte) (cipher.Block, error)
+	switch scheme := params.EncryptionScheme.Algorithm; {
+	case scheme.Equal(oidAES128CBC):
+		keyLength, newCipher = 16, aes.NewCipher
+	case scheme.Equal(oidAES192CBC):
+		keyLength, newCipher = 24, aes.NewCipher
+	case scheme.Equal(oidAES256CBC):
+		keyLength, newCipher = 32, aes.NewCipher
+	case scheme.Equal(oidDESEDE3CBC):
+		keyLength, newCipher = 24, des.NewTripleDESCipher
+	default:
+		return nil, errors.New("unsupported PBES2 encryption scheme " + scheme.String())
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, errors.New("failed to parse PBES2 encryption scheme IV: " + err.Error())
+	}
+
+	key, err := pbkdf2.Key(prf, string(passphrase), kdfParams.Salt, kdfParams.IterationCount, keyLength)
+	if err != nil {
+		return nil, errors.New("failed to derive key from ssl_private_key_passphrase: " + err.Error())
+	}
+	block, err := newCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() || len(info.EncryptedData) == 0 || len(info.EncryptedData)%block.BlockSize() != 0 {
+		return nil, errors.New("malformed encrypted PKCS#8 private key")
+	}
+
+	plain := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, info.EncryptedData)
+
+	// strip and verify the PKCS#7 padding, a mismatch almost always means a wrong passphrase
+	padding := int(plain[len(plain)-1])
+	if padding == 0 || padding > block.BlockSize() || !bytes.Equal(plain[len(plain)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, errors.New("failed to decrypt private key, wrong ssl_private_key_passphrase?")
+	}
+	return plain[:len(plain)-padding], nil
+}
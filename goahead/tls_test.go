@@ -0,0 +1,164 @@
+package goahead
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// spinUpClientCertServer starts a TLS server that requires a client certificate signed by
+// tests/ssl/ca.pem and answers with the common name of the presented certificate
+func spinUpClientCertServer(t *testing.T) (*httptest.Server, string) {
+	caPEM, err := os.ReadFile("../tests/ssl/ca.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(caPEM)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	ts.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+
+	// trust the self-signed server certificate of the test server
+	serverCaFile := filepath.Join(t.TempDir(), "server-ca.pem")
+	serverCaPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := os.WriteFile(serverCaFile, serverCaPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return ts, serverCaFile
+}
+
+func getCommonName(t *testing.T, c *http.Client, url string) string {
+	resp, err := c.Get(url)
+	if err != nil {
+		t.Fatalf("request to %s failed: %s", url, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestClientCertificateKeyFormats(t *testing.T) {
+	ts, serverCaFile := spinUpClientCertServer(t)
+
+	tests := []struct {
+		certificateFile    string
+		privateKey         string
+		passphrase         string
+		expectedCommonName string
+	}{
+		{"../tests/ssl/client-rsa.pem", "../tests/ssl/client-rsa.key", "", "client-rsa"},
+		{"../tests/ssl/client-rsa.pem", "../tests/ssl/client-rsa-pkcs8.key", "", "client-rsa"},
+		{"../tests/ssl/client-rsa.pem", "../tests/ssl/client-rsa-encrypted.key", "goahead", "client-rsa"},
+		{"../tests/ssl/client-rsa.pem", "../tests/ssl/client-rsa-pkcs8-encrypted.key", "goahead", "client-rsa"},
+		{"../tests/ssl/client-ec.pem", "../tests/ssl/client-ec.key", "", "client-ec"},
+	}
+	for _, test := range tests {
+		c, err := New(Config{
+			ServiceURL:               ts.URL,
+			CAFile:                   serverCaFile,
+			CertificateFile:          test.certificateFile,
+			PrivateKeyFile:           test.privateKey,
+			PrivateKeyPassphrase:     test.passphrase,
+			RequireClientCertificate: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cn := getCommonName(t, c.httpClient, ts.URL); cn != test.expectedCommonName {
+			t.Errorf("using %s the server saw client certificate %s, but we expected %s", test.privateKey, cn, test.expectedCommonName)
+		}
+	}
+}
+
+func TestClientCertificateWrongPassphrase(t *testing.T) {
+	for _, keyFile := range []string{"../tests/ssl/client-rsa-encrypted.key", "../tests/ssl/client-rsa-pkcs8-encrypted.key"} {
+		_, err := loadX509KeyPair("../tests/ssl/client-rsa.pem", keyFile, "wrong")
+		if err == nil {
+			t.Errorf("loading %s with a wrong passphrase should fail", keyFile)
+		}
+	}
+}
+
+func TestClientCertificateRotation(t *testing.T) {
+	ts, serverCaFile := spinUpClientCertServer(t)
+
+	dir := t.TempDir()
+	copyFile := func(src string, dst string, modTime time.Time) {
+		data, err := os.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(dst, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		// make sure the rotation is visible even on file systems with coarse timestamps
+		if err := os.Chtimes(dst, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	certificateFile := filepath.Join(dir, "client.pem")
+	privateKey := filepath.Join(dir, "client.key")
+	copyFile("../tests/ssl/client-rsa.pem", certificateFile, time.Now().Add(-time.Hour))
+	copyFile("../tests/ssl/client-rsa.key", privateKey, time.Now().Add(-time.Hour))
+
+	c, err := New(Config{
+		ServiceURL:               ts.URL,
+		CAFile:                   serverCaFile,
+		CertificateFile:          certificateFile,
+		PrivateKeyFile:           privateKey,
+		RequireClientCertificate: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cn := getCommonName(t, c.httpClient, ts.URL); cn != "client-rsa" {
+		t.Errorf("server saw client certificate %s, but we expected client-rsa", cn)
+	}
+
+	copyFile("../tests/ssl/client-rotated.pem", certificateFile, time.Now())
+	copyFile("../tests/ssl/client-rotated.key", privateKey, time.Now())
+	// force a new TLS handshake
+	c.httpClient.CloseIdleConnections()
+
+	if cn := getCommonName(t, c.httpClient, ts.URL); cn != "client-rotated" {
+		t.Errorf("server saw client certificate %s after rotation, but we expected client-rotated", cn)
+	}
+}
+
+func TestClientCertificateRequiredButUnusable(t *testing.T) {
+	_, err := New(Config{
+		ServiceURL:               "https://127.0.0.1:8443/",
+		CertificateFile:          "../tests/ssl/client-rsa.pem",
+		PrivateKeyFile:           "../tests/ssl/client-rsa-encrypted.key",
+		RequireClientCertificate: true,
+	})
+	expectedError := "ssl_require_and_verify_client_cert is enabled, but no usable client certificate could be loaded. Failed to parse ssl_private_key ../tests/ssl/client-rsa-encrypted.key Error: private key is encrypted, but no ssl_private_key_passphrase is configured"
+	if err == nil || err.Error() != expectedError {
+		t.Errorf("New() returned error '%v', but we expected '%s'", err, expectedError)
+	}
+
+	_, err = New(Config{ServiceURL: "https://127.0.0.1:8443/", RequireClientCertificate: true})
+	if err == nil {
+		t.Errorf("New() should fail if a client certificate is required, but none is configured")
+	}
+}
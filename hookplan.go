@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	h "github.com/xorpaul/gohelper"
+)
+
+// plannedHook is a restart hook with its settings and the hooks which have to finish before it
+// is started
+type plannedHook struct {
+	file     string
+	settings hookSettings
+	// after contains the indexes of the hooks of the plan which this hook waits for
+	after []int
+}
+
+// hookGroup returns the numeric prefix of the hook, e.g. 100 for 100_drain.sh. Hooks with the same
+// prefix are executed in parallel if os_restart_hooks_parallel is set. Without it or without a
+// numeric prefix each hook is a group of its own.
+func hookGroup(file string) string {
+	if !config.OsRestartHooksParallel {
+		return ""
+	}
+	name := filepath.Base(file)
+	return name[:len(name)-len(strings.TrimLeft(name, "0123456789"))]
+}
+
+// planRestartHooks loads the settings of the hooks and determines which hooks each hook waits for:
+// all hooks of the previous group and the hooks of the same phase named in its after setting. Without
+// os_restart_hooks_parallel the after settings move a hook behind the named hooks. If the settings of
+// a hook are invalid, the hook is returned with the error.
+func planRestartHooks(hooks []string) ([]plannedHook, string, error) {
+	settings := make([]hookSettings, len(hooks))
+	index := make(map[string]int)
+	for i, file := range hooks {
+		var err error
+		if settings[i], err = loadHookSettings(file); err != nil {
+			return nil, file, err
+		}
+		index[filepath.Base(file)] = i
+	}
+	after := make([][]int, len(hooks))
+	for i, file := range hooks {
+		for _, name := range settings[i].After {
+			j, ok := index[name]
+			if !ok {
+				return nil, file, errors.New("Unknown hook " + name + " in after setting of hook " + file + ", expected the name of a hook of the same phase")
+			}
+			after[i] = append(after[i], j)
+		}
+	}
+
+	order := make([]int, len(hooks))
+	for i := range order {
+		order[i] = i
+	}
+	if !config.OsRestartHooksParallel {
+		var invalid int
+		if order, invalid = orderRestartHooks(after); order == nil {
+			return nil, hooks[invalid], errors.New("Found circular dependency of hook " + hooks[invalid])
+		}
+	}
+
+	plan := make([]plannedHook, len(hooks))
+	position := make([]int, len(hooks))
+	var previous, current []int
+	currentGroup := ""
+	for i, k := range order {
+		group := hookGroup(hooks[k])
+		if i > 0 && (len(group) == 0 || group != currentGroup) {
+			previous, current = current, nil
+		}
+		currentGroup = group
+		plan[i] = plannedHook{file: hooks[k], settings: settings[k], after: previous}
+		current = append(current, i)
+		position[k] = i
+	}
+	for i, k := range order {
+		for _, j := range after[k] {
+			if !containsIndex(plan[i].after, position[j]) {
+				plan[i].after = append(append([]int{}, plan[i].after...), position[j])
+			}
+		}
+	}
+
+	// 0 unvisited, 1 on the current path, 2 checked
+	visited := make([]int, len(plan))
+	var visit func(i int) error
+	visit = func(i int) error {
+		if visited[i] == 1 {
+			return errors.New("Found circular dependency of hook " + plan[i].file)
+		}
+		if visited[i] == 2 {
+			return nil
+		}
+		visited[i] = 1
+		for _, j := range plan[i].after {
+			if err := visit(j); err != nil {
+				return err
+			}
+		}
+		visited[i] = 2
+		return nil
+	}
+	for i := range plan {
+		if err := visit(i); err != nil {
+			return nil, plan[i].file, err
+		}
+	}
+	return plan, "", nil
+}
+
+// orderRestartHooks sorts the hooks, given by the indexes of the hooks each hook has to run after,
+// so that each hook follows the hooks it has to run after and otherwise keeps its position. If the
+// hooks depend on each other in a circle, it returns nil and the first hook which could not be
+// ordered.
+func orderRestartHooks(after [][]int) ([]int, int) {
+	order := make([]int, 0, len(after))
+	placed := make([]bool, len(after))
+	for len(order) < len(after) {
+		next := -1
+		for i := range after {
+			if placed[i] {
+				continue
+			}
+			ready := true
+			for _, j := range after[i] {
+				ready = ready && placed[j]
+			}
+			if ready {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			for i := range after {
+				if !placed[i] {
+					return nil, i
+				}
+			}
+		}
+		placed[next] = true
+		order = append(order, next)
+	}
+	return order, 0
+}
+
+// containsIndex checks if the index is part of the list
+func containsIndex(list []int, index int) bool {
+	for _, i := range list {
+		if i == index {
+			return true
+		}
+	}
+	return false
+}
+
+// waitsFor describes the hooks the hook waits for, if it does not simply wait for the previous hook
+func (p plannedHook) waitsFor(plan []plannedHook) string {
+	if len(p.after) == 0 || (!config.OsRestartHooksParallel && len(p.settings.After) == 0) {
+		return ""
+	}
+	var names []string
+	for _, j := range p.after {
+		names = append(names, filepath.Base(plan[j].file))
+	}
+	return " after " + strings.Join(names, ",")
+}
+
+// runHookPlan executes each hook of the plan as soon as all hooks it waits for finished. It returns
+// the results of the failed hooks which do not allow to fail in the order of the plan. If
+// stopOnFailure is set, no further hooks are started after such a failure, but running hooks are
+// allowed to finish.
+func runHookPlan(ctx context.Context, phase hookPhase, plan []plannedHook, input hookInput, stopOnFailure bool) []scriptResult {
+	done := make([]chan struct{}, len(plan))
+	for i := range plan {
+		done[i] = make(chan struct{})
+	}
+	results := make([]*scriptResult, len(plan))
+	var mutex sync.Mutex
+	stopped := false
+	var wg sync.WaitGroup
+	for i, hook := range plan {
+		wg.Add(1)
+		go func(i int, hook plannedHook) {
+			defer wg.Done()
+			defer close(done[i])
+			for _, j := range hook.after {
+				<-done[j]
+			}
+			mutex.Lock()
+			skip := stopped
+			mutex.Unlock()
+			if skip {
+				h.Debugf("Skipping " + string(phase) + " hook " + hook.file + ", because a hook failed")
+				return
+			}
+
+			result := runRestartHook(ctx, phase, hook.file, hook.settings, input)
+			if result.Err == nil && result.ReturnCode == 0 {
+				return
+			}
+			message := string(phase) + " hook " + hook.file + " failed with exit code " + strconv.Itoa(result.ReturnCode)
+			switch {
+			case hook.settings.allowFail():
+				h.Infof(message + ", continuing because of allow_fail Output: " + result.Output)
+				return
+			case stopOnFailure:
+				h.Infof(message + ", aborting the restart Output: " + result.Output)
+			default:
+				h.Infof(message + " Output: " + result.Output)
+			}
+			mutex.Lock()
+			if stopOnFailure {
+				stopped = true
+			}
+			results[i] = &result
+			mutex.Unlock()
+		}(i, hook)
+	}
+	wg.Wait()
+
+	var failed []scriptResult
+	for _, result := range results {
+		if result != nil {
+			failed = append(failed, *result)
+		}
+	}
+	return failed
+}
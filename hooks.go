@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xorpaul/goahead_client/goahead"
+	h "github.com/xorpaul/gohelper"
+)
+
+// hookPhase is a stage of the restart. The phases are subdirectories of os_restart_hooks_dir named
+// after the phase with the suffix .d, e.g. pre_restart.d.
+type hookPhase string
+
+const (
+	// phasePreRestart hooks prepare the restart, e.g. drain the node and silence the monitoring
+	phasePreRestart hookPhase = "pre_restart"
+	// phaseRestart hooks restart the host
+	phaseRestart hookPhase = "restart"
+	// phaseOnAbort hooks undo the pre_restart hooks if a pre_restart or restart hook failed
+	phaseOnAbort hookPhase = "on_abort"
+	// phaseRestartAction is the built-in restart_action, it has no directory
+	phaseRestartAction hookPhase = "restart_action"
+)
+
+// hookPhases are all phases in the order of a restart
+var hookPhases = []hookPhase{phasePreRestart, phaseRestart, phaseOnAbort}
+
+// restartAbortedStatus marks a granted restart which was aborted, because a restart hook failed
+const restartAbortedStatus = "hooks_failed"
+
+// dir returns the directory of the phase in os_restart_hooks_dir
+func (p hookPhase) dir() string {
+	return filepath.Join(config.OsRestartHooksDir, string(p)+".d")
+}
+
+// phasedRestartHooks checks if os_restart_hooks_dir contains phase directories. Without them all
+// files of os_restart_hooks_dir are pre_restart hooks and the last one is expected to restart the host.
+func phasedRestartHooks() bool {
+	for _, phase := range hookPhases {
+		if h.IsDir(phase.dir()) {
+			return true
+		}
+	}
+	return false
+}
+
+// findRestartHooks returns the scripts of the phase in the order they are executed
+func findRestartHooks(phase hookPhase) ([]string, error) {
+	if len(config.OsRestartHooksDir) == 0 || !h.IsDir(config.OsRestartHooksDir) {
+		return nil, nil
+	}
+	dir := phase.dir()
+	if !phasedRestartHooks() {
+		if phase != phasePreRestart {
+			return nil, nil
+		}
+		dir = config.OsRestartHooksDir
+	} else if !h.IsDir(dir) {
+		return nil, nil
+	}
+	matches, err := findScripts(dir)
+	if err != nil {
+		return nil, errors.New("Failed to glob " + string(phase) + " hook script directory " + dir + " Error: " + err.Error())
+	}
+	var hooks []string
+	for _, match := range matches {
+		if !h.IsDir(match) && !isHookSettingsFile(match) {
+			hooks = append(hooks, match)
+		}
+	}
+	return hooks, nil
+}
+
+// checkRestartHooks returns an error if there are no pre_restart or restart hooks at all and no
+// restart_action, because the host would never be restarted
+func checkRestartHooks() error {
+	if len(config.RestartAction.Type) > 0 {
+		return nil
+	}
+	preRestartHooks, err := findRestartHooks(phasePreRestart)
+	if err != nil {
+		return err
+	}
+	restartHooks, err := findRestartHooks(phaseRestart)
+	if err != nil {
+		return err
+	}
+	if len(preRestartHooks) == 0 && len(restartHooks) == 0 {
+		return errors.New("Could not find any restart hook scripts in " + config.OsRestartHooksDir)
+	}
+	return nil
+}
+
+// planPhase finds the restart hooks of the phase and plans their execution. If they can not be
+// found or the settings of a hook are invalid, the hook or directory is returned with the error.
+func planPhase(phase hookPhase) ([]plannedHook, string, error) {
+	hooks, err := findRestartHooks(phase)
+	if err != nil {
+		return nil, config.OsRestartHooksDir, err
+	}
+	if len(hooks) > 0 {
+		h.Debugf("found " + string(phase) + " hook scripts: " + strings.Join(hooks, " "))
+	}
+	return planRestartHooks(hooks)
+}
+
+// hookInput is the context of the restart which is passed to each restart hook
+type hookInput struct {
+	// env contains the GOAHEAD_ environment variables except GOAHEAD_PHASE
+	env []string
+	// stdin is the response of the goahead service as JSON
+	stdin []byte
+}
+
+// newHookInput prepares the environment variables and the standard input of the restart hooks
+func newHookInput(response goahead.Response) (hookInput, error) {
+	serviceURL := response.ServiceURL
+	if len(serviceURL) == 0 {
+		serviceURL = config.ServiceUrl
+	}
+	// without requesting_fqdn the payload falls back to the hostname, which the service echoes
+	if len(response.RequestingFqdn) == 0 {
+		fqdn, err := getPayloadFqdn()
+		if err != nil {
+			return hookInput{}, err
+		}
+		response.RequestingFqdn = fqdn
+	}
+	stdin, err := json.Marshal(response)
+	if err != nil {
+		return hookInput{}, errors.New("Failed to marshal the goahead response for the restart hooks Error: " + err.Error())
+	}
+	return hookInput{
+		env: []string{
+			"GOAHEAD_REQUEST_ID=" + response.RequestID,
+			"GOAHEAD_RESTART_REASON=" + grantedRestartReason(response),
+			"GOAHEAD_CLUSTER=" + response.FoundCluster,
+			"GOAHEAD_FQDN=" + response.RequestingFqdn,
+			"GOAHEAD_SERVICE_URL=" + serviceURL,
+		},
+		stdin: append(stdin, '\n'),
+	}, nil
+}
+
+// executeRestartHooks executes the pre_restart and restart hooks and then the restart_action. If
+// one of the hooks fails and allow_fail is not set for it or the restart_action fails, the restart
+// is aborted: the on_abort hooks are executed and the goahead service is told about the abort.
+// Running hooks are allowed to finish even if the context is canceled.
+func executeRestartHooks(ctx context.Context, response goahead.Response) int {
+	input, err := newHookInput(response)
+	if err == nil {
+		err = checkRestartHooks()
+	}
+	if err != nil {
+		h.Infof("Could not prepare the restart hooks, aborting the restart Error: " + err.Error())
+		abortRestart(context.WithoutCancel(ctx), response, phasePreRestart, []scriptResult{{Script: config.OsRestartHooksDir, ReturnCode: -1, Err: err, Output: err.Error()}})
+		return exitCodeRestartHooksFailed
+	}
+	for _, phase := range []hookPhase{phasePreRestart, phaseRestart} {
+		plan, invalidHook, err := planPhase(phase)
+		if err != nil {
+			h.Infof("Invalid " + string(phase) + " hook " + invalidHook + ", aborting the restart Error: " + err.Error())
+			abortRestart(context.WithoutCancel(ctx), response, phase, []scriptResult{{Script: invalidHook, ReturnCode: -1, Err: err, Output: err.Error()}})
+			return exitCodeRestartHooksFailed
+		}
+		if failed := runHookPlan(context.WithoutCancel(ctx), phase, plan, input, true); len(failed) > 0 {
+			abortRestart(context.WithoutCancel(ctx), response, phase, failed)
+			return exitCodeRestartHooksFailed
+		}
+	}
+	if result, ok := executeRestartAction(ctx, response); !ok {
+		h.Infof("restart_action " + config.RestartAction.Type + " failed with exit code " + strconv.Itoa(result.ReturnCode) + ", aborting the restart Output: " + result.Output)
+		result.Script = config.RestartAction.Type
+		abortRestart(context.WithoutCancel(ctx), response, phaseRestartAction, []scriptResult{result})
+		return exitCodeRestartHooksFailed
+	}
+	return exitCodeOK
+}
+
+// runRestartHook executes the hook with its settings and the input and retries it if it fails. It
+// returns the result of the last attempt.
+func runRestartHook(ctx context.Context, phase hookPhase, file string, settings hookSettings, input hookInput) scriptResult {
+	// the GOAHEAD_ variables can not be overridden by the environment of the hook settings
+	env := append(settings.env(), input.env...)
+	options := scriptOptions{Timeout: settings.Timeout, Env: append(env, "GOAHEAD_PHASE="+string(phase)), Stdin: input.stdin}
+	for attempt := 1; ; attempt++ {
+		result := executeScript(ctx, options, file)
+		if result.Err != nil {
+			result.Output = result.Err.Error() + " " + result.Output
+		}
+		if (result.Err == nil && result.ReturnCode == 0) || attempt > settings.Retries {
+			return result
+		}
+		h.Infof(string(phase) + " hook " + file + " failed with exit code " + strconv.Itoa(result.ReturnCode) + ", retrying in " + settings.RetryDelay.String() + " (attempt " + strconv.Itoa(attempt+1) + "/" + strconv.Itoa(settings.Retries+1) + ") Output: " + result.Output)
+		time.Sleep(settings.RetryDelay)
+	}
+}
+
+// abortRestart executes the on_abort hooks, which are all executed even if some of them fail, and
+// tells the goahead service that the granted restart was aborted because of the failed hooks
+func abortRestart(ctx context.Context, response goahead.Response, phase hookPhase, failed []scriptResult) {
+	plan, invalidHook, err := planPhase(phaseOnAbort)
+	input, inputErr := newHookInput(response)
+	if err != nil {
+		h.Infof("Not executing any on_abort hooks, because of invalid on_abort hook " + invalidHook + " Error: " + err.Error())
+	} else if inputErr != nil {
+		h.Infof("Not executing any on_abort hooks Error: " + inputErr.Error())
+	} else {
+		runHookPlan(ctx, phaseOnAbort, plan, input, false)
+	}
+
+	if len(response.RequestID) == 0 {
+		// the restart hooks were executed without negotiating the restart
+		return
+	}
+	report := goahead.RestartAbortedReport{
+		Phase:      string(phase),
+		FailedHook: failed[0].Script,
+		ReturnCode: failed[0].ReturnCode,
+		Output:     failed[0].Output,
+	}
+	// hooks which were executed in parallel can fail together
+	if len(failed) > 1 {
+		for _, result := range failed {
+			report.FailedHooks = append(report.FailedHooks, result.Script)
+		}
+	}
+	reportRestartAborted(ctx, response, report, restartAbortedStatus)
+}
+
+// printRestartHooks prints the restart hooks executeRestartHooks would execute in their order
+func printRestartHooks() {
+	h.Infof("Dry run: received go ahead to restart, not executing any restart hooks")
+	if err := checkRestartHooks(); err != nil {
+		h.Infof("Dry run: would abort the restart Error: " + err.Error())
+		return
+	}
+	for _, phase := range hookPhases {
+		condition := ""
+		if phase == phaseOnAbort {
+			condition = " if a hook fails"
+		}
+		plan, invalidHook, err := planPhase(phase)
+		if err != nil {
+			h.Infof("Dry run: would fail because of invalid " + string(phase) + " hook " + invalidHook + ": " + err.Error())
+			continue
+		}
+		for i, hook := range plan {
+			h.Infof("Dry run: would execute " + string(phase) + " hook " + strconv.Itoa(i+1) + "/" + strconv.Itoa(len(plan)) + " " + hook.file + " with timeout " + hook.settings.Timeout.String() + " and allow_fail " + strconv.FormatBool(hook.settings.allowFail()) + hook.waitsFor(plan) + condition)
+		}
+		if phase == phaseRestart && len(config.RestartAction.Type) > 0 {
+			h.Infof("Dry run: would execute restart_action " + config.RestartAction.Type + " after a delay of " + config.RestartAction.Delay.String())
+		}
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xorpaul/goahead_client/goahead"
+	H "github.com/xorpaul/gohelper"
+)
+
+// readHookOutput returns the lines the test hooks appended to $GOAHEAD_TEST_OUTPUT
+func readHookOutput(t *testing.T, file string) []string {
+	data, err := os.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+// runTestHook executes the hook with its settings
+func runTestHook(t *testing.T, phase hookPhase, file string, input hookInput) scriptResult {
+	settings, err := loadHookSettings(file)
+	if err != nil {
+		t.Fatalf("loadHookSettings(%s) returned error %v", file, err)
+	}
+	return runRestartHook(context.Background(), phase, file, settings, input)
+}
+
+// testHookInput prepares the input of the restart hooks for the response
+func testHookInput(t *testing.T, response goahead.Response) hookInput {
+	input, err := newHookInput(response)
+	if err != nil {
+		t.Fatalf("newHookInput returned error %v", err)
+	}
+	return input
+}
+
+func TestFindRestartHooks(t *testing.T) {
+	savedConfig := config
+	defer func() { config = savedConfig }()
+
+	// without phase directories all scripts are pre_restart hooks
+	config.OsRestartHooksDir = "./tests/TestRestartHooks/"
+	expected := map[hookPhase][]string{
+		phasePreRestart: {"tests/TestRestartHooks/001_pre_restart_trigger01.sh", "tests/TestRestartHooks/999_last_trigger.sh"},
+	}
+	for _, phase := range hookPhases {
+		if hooks, err := findRestartHooks(phase); err != nil || !reflect.DeepEqual(hooks, expected[phase]) {
+			t.Errorf("findRestartHooks(%s) returned %q, but we expected %q", phase, hooks, expected[phase])
+		}
+	}
+
+	config.OsRestartHooksDir = "./tests/TestRestartHookPhases/"
+	expected = map[hookPhase][]string{
+		phasePreRestart: {"tests/TestRestartHookPhases/pre_restart.d/010_drain.sh", "tests/TestRestartHookPhases/pre_restart.d/020_silence_monitoring.sh"},
+		phaseRestart:    {"tests/TestRestartHookPhases/restart.d/999_restart.sh"},
+		phaseOnAbort:    {"tests/TestRestartHookPhases/on_abort.d/010_undrain.sh"},
+	}
+	for _, phase := range hookPhases {
+		if hooks, err := findRestartHooks(phase); err != nil || !reflect.DeepEqual(hooks, expected[phase]) {
+			t.Errorf("findRestartHooks(%s) returned %q, but we expected %q", phase, hooks, expected[phase])
+		}
+	}
+}
+
+func TestExecuteRestartHookPhases(t *testing.T) {
+	savedConfig := config
+	defer func() { config = savedConfig }()
+	config.OsRestartHooksDir = "./tests/TestRestartHookPhases/"
+	output := filepath.Join(t.TempDir(), "hooks.log")
+	t.Setenv("GOAHEAD_TEST_OUTPUT", output)
+
+	if exitCode := executeRestartHooks(context.Background(), goahead.Response{RequestID: "sqEALyco"}); exitCode != exitCodeOK {
+		t.Errorf("executeRestartHooks returned exit code %d, but we expected %d", exitCode, exitCodeOK)
+	}
+	expected := []string{"pre_restart 010_drain.sh", "pre_restart 020_silence_monitoring.sh", "restart 999_restart.sh"}
+	if lines := readHookOutput(t, output); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("hooks were executed in order %q, but we expected %q", lines, expected)
+	}
+}
+
+func TestExecuteRestartHookPhasesFailing(t *testing.T) {
+	savedConfig := config
+	defer func() { config = savedConfig }()
+	config.OsRestartHooksDir = "./tests/TestRestartHookPhasesFailing/"
+	config.StateFile = filepath.Join(t.TempDir(), "state.json")
+	output := filepath.Join(t.TempDir(), "hooks.log")
+	t.Setenv("GOAHEAD_TEST_OUTPUT", output)
+	fakeMutex.Lock()
+	fakeAbortReports = nil
+	fakeMutex.Unlock()
+
+	granted := restartState{RequestID: "sqEALyco", RestartReason: "testing", RestartReasons: testReasons, Status: "granted", RequestedAt: time.Now(), GrantedAt: time.Now()}
+	if err := writeRestartState(config.StateFile, granted); err != nil {
+		t.Fatal(err)
+	}
+
+	response := goahead.Response{RequestID: "sqEALyco", Goahead: true, ServiceURL: ts.URL + "/"}
+	if exitCode := executeRestartHooks(context.Background(), response); exitCode != exitCodeRestartHooksFailed {
+		t.Errorf("executeRestartHooks returned exit code %d, but we expected %d", exitCode, exitCodeRestartHooksFailed)
+	}
+	// the failing hook stops the restart and all on_abort hooks are executed, even if one fails
+	expected := []string{"pre_restart 010_drain.sh", "pre_restart 015_failing.sh", "on_abort 005_failing_undo.sh", "on_abort 010_undrain.sh"}
+	if lines := readHookOutput(t, output); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("hooks were executed in order %q, but we expected %q", lines, expected)
+	}
+
+	state, _ := readRestartState(config.StateFile)
+	if state.Status != restartAbortedStatus {
+		t.Errorf("state has status %s after the abort, but we expected %s", state.Status, restartAbortedStatus)
+	}
+
+	fakeMutex.Lock()
+	defer fakeMutex.Unlock()
+	if len(fakeAbortReports) != 1 {
+		t.Fatalf("service received %d abort reports, but we expected 1", len(fakeAbortReports))
+	}
+	report := fakeAbortReports[0]
+	if report.RequestID != "sqEALyco" || report.Phase != "pre_restart" || report.FailedHook != "tests/TestRestartHookPhasesFailing/pre_restart.d/015_failing.sh" || report.ReturnCode != 3 || !strings.Contains(report.Output, "could not drain node") || report.RestartReason != "testing" {
+		t.Errorf("service received abort report %+v", report)
+	}
+
+	// with os_restart_hooks_allow_fail the failing hook is ignored
+	config.OsRestartHooksAllowFail = true
+	os.Remove(output)
+	if exitCode := executeRestartHooks(context.Background(), goahead.Response{}); exitCode != exitCodeOK {
+		t.Errorf("executeRestartHooks returned exit code %d with os_restart_hooks_allow_fail, but we expected %d", exitCode, exitCodeOK)
+	}
+	expected = []string{"pre_restart 010_drain.sh", "pre_restart 015_failing.sh", "pre_restart 020_silence_monitoring.sh", "restart 999_restart.sh"}
+	if lines := readHookOutput(t, output); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("hooks were executed in order %q with os_restart_hooks_allow_fail, but we expected %q", lines, expected)
+	}
+}
+
+func TestLoadHookSettings(t *testing.T) {
+	savedConfig := config
+	defer func() { config = savedConfig }()
+	config.OsRestartHooksTimeout = 10 * time.Second
+	config.OsRestartHooksAllowFail = false
+
+	tests := []struct {
+		file      string
+		timeout   time.Duration
+		retries   int
+		allowFail bool
+		env       []string
+	}{
+		{"010_header.sh", 300 * time.Second, 2, true, nil},
+		// the sidecar file overrides the timeout of the header comments
+		{"020_sidecar.sh", time.Minute, 1, false, []string{"DRAIN_MODE=graceful"}},
+		{"030_defaults.sh", 10 * time.Second, 0, false, nil},
+	}
+	for _, test := range tests {
+		settings, err := loadHookSettings(filepath.Join("tests/TestHookSettings", test.file))
+		if err != nil {
+			t.Errorf("loadHookSettings(%s) returned error %v", test.file, err)
+			continue
+		}
+		if settings.Timeout != test.timeout || settings.Retries != test.retries || settings.allowFail() != test.allowFail || !reflect.DeepEqual(settings.env(), test.env) {
+			t.Errorf("loadHookSettings(%s) returned %s env %q, but we expected timeout %s retries %d allow_fail %t env %q", test.file, settings, settings.env(), test.timeout, test.retries, test.allowFail, test.env)
+		}
+	}
+
+	if _, err := loadHookSettings("tests/TestHookSettings/060_invalid.sh"); err == nil || !strings.Contains(err.Error(), "invalid value of timeout: soon") {
+		t.Errorf("loadHookSettings returned error %v for an invalid timeout", err)
+	}
+	// the sidecar files are no hooks
+	config.OsRestartHooksDir = "./tests/TestHookSettings/"
+	hooks, err := findRestartHooks(phasePreRestart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hook := range hooks {
+		if isHookSettingsFile(hook) {
+			t.Errorf("findRestartHooks returned the hook settings file %s", hook)
+		}
+	}
+}
+
+func TestRunRestartHookSettings(t *testing.T) {
+	savedConfig := config
+	defer func() { config = savedConfig }()
+	config.OsRestartHooksTimeout = 10 * time.Second
+	output := filepath.Join(t.TempDir(), "hooks.log")
+	t.Setenv("GOAHEAD_TEST_OUTPUT", output)
+
+	if result := runTestHook(t, phasePreRestart, "tests/TestHookSettings/020_sidecar.sh", hookInput{}); result.ReturnCode != 0 {
+		t.Errorf("runRestartHook returned %+v for 020_sidecar.sh", result)
+	}
+	// the flaky hook succeeds on the second attempt
+	result := runTestHook(t, phasePreRestart, "tests/TestHookSettings/040_flaky.sh", hookInput{})
+	if result.ReturnCode != 0 {
+		t.Errorf("runRestartHook returned %+v for 040_flaky.sh, but we expected it to succeed on a retry", result)
+	}
+	expected := []string{"pre_restart 020_sidecar.sh graceful", "pre_restart 040_flaky.sh", "pre_restart 040_flaky.sh"}
+	if lines := readHookOutput(t, output); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("hooks wrote %q, but we expected %q", lines, expected)
+	}
+
+	start := time.Now()
+	result = runTestHook(t, phasePreRestart, "tests/TestHookSettings/050_slow.sh", hookInput{})
+	if result.Err == nil || !strings.Contains(result.Output, "killed after timeout of 100ms") || time.Since(start) > 3*time.Second {
+		t.Errorf("runRestartHook returned %+v after %s for 050_slow.sh, but we expected it to be killed after 100ms", result, time.Since(start))
+	}
+
+	// a hook with invalid settings fails the whole phase before any hook is executed
+	config.OsRestartHooksDir = "./tests/TestHookSettings/"
+	if _, invalidHook, err := planPhase(phasePreRestart); err == nil || invalidHook != "tests/TestHookSettings/060_invalid.sh" {
+		t.Errorf("planRestartHooks returned invalid hook %s with error %v, but we expected 060_invalid.sh to be invalid", invalidHook, err)
+	}
+}
+
+func TestRestartHookInput(t *testing.T) {
+	savedConfig := config
+	defer func() { config = savedConfig }()
+	config.OsRestartHooksTimeout = 10 * time.Second
+	config.Fqdn = "foobar-server.domain.tld"
+	config.StateFile = filepath.Join(t.TempDir(), "state.json")
+	output := filepath.Join(t.TempDir(), "hooks.log")
+	t.Setenv("GOAHEAD_TEST_OUTPUT", output)
+
+	granted := restartState{RequestID: "sqEALyco", RestartReason: "kernel update", Status: "granted", RequestedAt: time.Now(), GrantedAt: time.Now()}
+	if err := writeRestartState(config.StateFile, granted); err != nil {
+		t.Fatal(err)
+	}
+	response := goahead.Response{RequestID: "sqEALyco", Goahead: true, FoundCluster: "db", RequestingFqdn: "foobar-server.domain.tld", ServiceURL: "https://goahead.domain.tld/"}
+	if result := runTestHook(t, phaseOnAbort, "tests/TestHookEnvironment/010_notify.sh", testHookInput(t, response)); result.ReturnCode != 0 {
+		t.Fatalf("runRestartHook returned %+v", result)
+	}
+
+	lines := readHookOutput(t, output)
+	if len(lines) != 2 {
+		t.Fatalf("hook wrote %q, but we expected the environment and the response", lines)
+	}
+	expected := "on_abort sqEALyco db foobar-server.domain.tld https://goahead.domain.tld/ kernel update"
+	if lines[0] != expected {
+		t.Errorf("hook received the environment %q, but we expected %q", lines[0], expected)
+	}
+	var received goahead.Response
+	if err := json.Unmarshal([]byte(lines[1]), &received); err != nil {
+		t.Fatalf("hook did not receive the response as JSON on stdin: %q Error: %v", lines[1], err)
+	}
+	response.ServiceURL = ""
+	if !reflect.DeepEqual(received, response) {
+		t.Errorf("hook received the response %+v, but we expected %+v", received, response)
+	}
+
+	// without requesting_fqdn and a response, e.g. for hooks run, the hostname is used
+	config.Fqdn = ""
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(output)
+	if result := runTestHook(t, phasePreRestart, "tests/TestHookEnvironment/010_notify.sh", testHookInput(t, goahead.Response{})); result.ReturnCode != 0 {
+		t.Fatalf("runRestartHook returned %+v", result)
+	}
+	lines = readHookOutput(t, output)
+	if len(lines) != 2 {
+		t.Fatalf("hook wrote %q, but we expected the environment and the response", lines)
+	}
+	if expected := "pre_restart   " + hostname + " " + config.ServiceUrl + " "; lines[0] != expected {
+		t.Errorf("hook received the environment %q, but we expected %q", lines[0], expected)
+	}
+	received = goahead.Response{}
+	if err := json.Unmarshal([]byte(lines[1]), &received); err != nil || received.RequestingFqdn != hostname {
+		t.Errorf("hook received the response %q on stdin, but we expected requesting_fqdn %s Error: %v", lines[1], hostname, err)
+	}
+}
+
+func TestPlanRestartHooks(t *testing.T) {
+	savedConfig := config
+	defer func() { config = savedConfig }()
+	config.OsRestartHooksTimeout = 10 * time.Second
+	config.OsRestartHooksDir = "./tests/TestRestartHooks/"
+
+	// the hooks of different groups are executed in order with and without os_restart_hooks_parallel
+	for _, parallel := range []bool{false, true} {
+		config.OsRestartHooksParallel = parallel
+		plan, _, err := planPhase(phasePreRestart)
+		if err != nil {
+			t.Fatal(err)
+		}
+		after := make([][]int, len(plan))
+		for i, hook := range plan {
+			after[i] = hook.after
+		}
+		if expected := [][]int{nil, {0}}; !reflect.DeepEqual(after, expected) {
+			t.Errorf("planRestartHooks returned the dependencies %v with os_restart_hooks_parallel %t, but we expected %v", after, parallel, expected)
+		}
+	}
+
+	config.OsRestartHooksDir = "./tests/TestRestartHookGroups/"
+	plan, _, err := planPhase(phasePreRestart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"", "", " after 100_notify_a.sh,100_notify_b.sh,200_b_stop_services.sh", " after 100_notify_a.sh,100_notify_b.sh", " after 200_a_silence_monitoring.sh,200_b_stop_services.sh"}
+	for i, hook := range plan {
+		if waitsFor := hook.waitsFor(plan); waitsFor != expected[i] {
+			t.Errorf("hook %s waits for '%s', but we expected '%s'", hook.file, waitsFor, expected[i])
+		}
+	}
+
+	// without os_restart_hooks_parallel the after setting moves a hook behind the named hook
+	config.OsRestartHooksParallel = false
+	plan, _, err = planPhase(phasePreRestart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var order []string
+	for _, hook := range plan {
+		order = append(order, filepath.Base(hook.file))
+	}
+	if expected := []string{"100_notify_a.sh", "100_notify_b.sh", "200_b_stop_services.sh", "200_a_silence_monitoring.sh", "999_restart.sh"}; !reflect.DeepEqual(order, expected) {
+		t.Errorf("planRestartHooks returned the hooks in order %q, but we expected %q", order, expected)
+	}
+	if waitsFor := plan[3].waitsFor(plan); waitsFor != " after 200_b_stop_services.sh" {
+		t.Errorf("hook %s waits for '%s', but we expected ' after 200_b_stop_services.sh'", plan[3].file, waitsFor)
+	}
+
+	if plan, _, err := planRestartHooks(nil); err != nil || len(plan) != 0 {
+		t.Errorf("planRestartHooks returned the plan %+v and error %v without hooks", plan, err)
+	}
+
+	// a circular dependency is invalid
+	dir := t.TempDir()
+	for file, after := range map[string]string{"100_a.sh": "100_b.sh", "100_b.sh": "100_a.sh"} {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte("#! /bin/bash\n# goahead: after="+after+"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config.OsRestartHooksDir = dir
+	for _, parallel := range []bool{false, true} {
+		config.OsRestartHooksParallel = parallel
+		if _, invalidHook, err := planPhase(phasePreRestart); err == nil || !strings.Contains(err.Error(), "circular dependency") {
+			t.Errorf("planRestartHooks returned invalid hook %s with error %v with os_restart_hooks_parallel %t, but we expected a circular dependency", invalidHook, err, parallel)
+		}
+	}
+}
+
+func TestRunHookPlanGroups(t *testing.T) {
+	savedConfig := config
+	defer func() { config = savedConfig }()
+	config.OsRestartHooksTimeout = 10 * time.Second
+	config.OsRestartHooksParallel = true
+	preRestartHooksFile := "/var/tmp/goahead_client/restart_was_triggered"
+
+	// 999_last_trigger.sh of the next group is only started after 001_pre_restart_trigger01.sh
+	// succeeded and never if it failed
+	for dir, expectedFailed := range map[string]int{"./tests/TestRestartHooks/": 0, "./tests/TestRestartHooksFailing/": 1} {
+		H.PurgeDir(preRestartHooksFile, H.FuncName())
+		config.OsRestartHooksDir = dir
+		plan, _, err := planPhase(phasePreRestart)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if failed := runHookPlan(context.Background(), phasePreRestart, plan, hookInput{}, true); len(failed) != expectedFailed {
+			t.Errorf("runHookPlan returned the failed hooks %+v for %s, but we expected %d", failed, dir, expectedFailed)
+		}
+		if triggered := H.FileExists(preRestartHooksFile); triggered != (expectedFailed == 0) {
+			t.Errorf("999_last_trigger.sh of %s was executed: %t, but we expected %t", dir, triggered, expectedFailed == 0)
+		}
+	}
+
+	config.OsRestartHooksDir = "./tests/TestRestartHookGroups/"
+	output := filepath.Join(t.TempDir(), "hooks.log")
+	t.Setenv("GOAHEAD_TEST_OUTPUT", output)
+	plan, _, err := planPhase(phasePreRestart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed := runHookPlan(context.Background(), phasePreRestart, plan, hookInput{}, true); len(failed) > 0 {
+		t.Fatalf("runHookPlan returned the failed hooks %+v", failed)
+	}
+
+	// the hooks of group 100 finish in any order before group 200 starts, within the group
+	// 200_a_silence_monitoring.sh waits for 200_b_stop_services.sh
+	lines := readHookOutput(t, output)
+	if len(lines) != 5 {
+		t.Fatalf("hooks wrote %q, but we expected 5 lines", lines)
+	}
+	group100 := append([]string{}, lines[:2]...)
+	sort.Strings(group100)
+	if expected := []string{"100_notify_a.sh", "100_notify_b.sh"}; !reflect.DeepEqual(group100, expected) {
+		t.Errorf("hooks were executed in order %q, but we expected the hooks of group 100 first", lines)
+	}
+	if expected := []string{"200_b_stop_services.sh", "200_a_silence_monitoring.sh", "999_restart.sh"}; !reflect.DeepEqual(lines[2:], expected) {
+		t.Errorf("hooks were executed in order %q after group 100, but we expected %q", lines[2:], expected)
+	}
+}
+
+func TestRunHookPlanGroupsFailing(t *testing.T) {
+	savedConfig := config
+	defer func() { config = savedConfig }()
+	config.OsRestartHooksTimeout = 10 * time.Second
+	config.OsRestartHooksParallel = true
+	config.OsRestartHooksDir = "./tests/TestRestartHookGroupsFailing/"
+	output := filepath.Join(t.TempDir(), "hooks.log")
+	t.Setenv("GOAHEAD_TEST_OUTPUT", output)
+
+	plan, _, err := planPhase(phasePreRestart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// all failures of the group are returned, the hook which may fail is ignored and the next group
+	// is not started
+	failed := runHookPlan(context.Background(), phasePreRestart, plan, hookInput{}, true)
+	if len(failed) != 2 || failed[0].ReturnCode != 2 || failed[1].ReturnCode != 3 || !strings.Contains(failed[1].Output, "could not drain b") {
+		t.Errorf("runHookPlan returned the failed hooks %+v, but we expected 100_drain_a.sh and 100_drain_b.sh", failed)
+	}
+	if lines, expected := readHookOutput(t, output), []string{"100_notify.sh"}; !reflect.DeepEqual(lines, expected) {
+		t.Errorf("hooks wrote %q, but we expected %q", lines, expected)
+	}
+
+	// without stopOnFailure like for the on_abort hooks all hooks are executed
+	os.Remove(output)
+	if failed := runHookPlan(context.Background(), phaseOnAbort, plan, hookInput{}, false); len(failed) != 2 {
+		t.Errorf("runHookPlan returned %d failed hooks, but we expected 2", len(failed))
+	}
+	if lines, expected := readHookOutput(t, output), []string{"100_notify.sh", "999_restart.sh"}; !reflect.DeepEqual(lines, expected) {
+		t.Errorf("hooks wrote %q, but we expected %q", lines, expected)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// hookSettingsPrefix starts the header comments of a restart hook which contain its settings
+const hookSettingsPrefix = "# goahead:"
+
+// hookSettings are the settings of a single restart hook. They are read from header comments of the
+// script like
+//
+//	# goahead: timeout=300s retries=2 allow_fail=true
+//
+// and from an optional sidecar file with the suffix .yml next to the script, e.g. 020_drain.sh.yml,
+// whose settings take precedence over the header comments.
+type hookSettings struct {
+	Timeout time.Duration `yaml:"timeout"`
+	// Retries is the number of additional attempts after the hook failed
+	Retries    int           `yaml:"retries"`
+	RetryDelay time.Duration `yaml:"retry_delay"`
+	// AllowFail defaults to os_restart_hooks_allow_fail if it is not set
+	AllowFail *bool `yaml:"allow_fail"`
+	// Environment is added to the environment of the hook
+	Environment map[string]string `yaml:"environment"`
+	// After contains the names of hooks of the same phase which have to finish before the hook starts
+	After []string `yaml:"after"`
+}
+
+// String describes the settings for the hook listings
+func (s hookSettings) String() string {
+	description := "timeout " + s.Timeout.String() + " retries " + strconv.Itoa(s.Retries) + " allow_fail " + strconv.FormatBool(s.allowFail())
+	if s.Retries > 0 {
+		description += " retry_delay " + s.RetryDelay.String()
+	}
+	return description
+}
+
+// allowFail returns if a failure of the hook should be ignored
+func (s hookSettings) allowFail() bool {
+	if s.AllowFail == nil {
+		return config.OsRestartHooksAllowFail
+	}
+	return *s.AllowFail
+}
+
+// env returns the Environment as list of NAME=value entries
+func (s hookSettings) env() []string {
+	var env []string
+	for name, value := range s.Environment {
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// isHookSettingsFile checks if the file is a sidecar file with hook settings instead of a hook
+func isHookSettingsFile(file string) bool {
+	return strings.HasSuffix(file, ".yml") || strings.HasSuffix(file, ".yaml")
+}
+
+// loadHookSettings returns the settings of the restart hook with the defaults for all settings
+// which are neither set in the header comments nor in the sidecar file
+func loadHookSettings(file string) (hookSettings, error) {
+	settings, err := readHookSettingsHeader(file)
+	if err != nil {
+		return settings, err
+	}
+	for _, sidecar := range []string{file + ".yml", file + ".yaml"} {
+		data, err := os.ReadFile(sidecar)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return settings, errors.New("Failed to read hook settings file " + sidecar + " Error: " + err.Error())
+		}
+		if err := yaml.UnmarshalStrict(data, &settings); err != nil {
+			return settings, errors.New("Failed to parse hook settings file " + sidecar + " Error: " + err.Error())
+		}
+		break
+	}
+
+	if settings.Timeout < 0 || settings.Retries < 0 || settings.RetryDelay < 0 {
+		return settings, errors.New("timeout, retries and retry_delay of hook " + file + " must not be negative")
+	}
+	if settings.Timeout == 0 {
+		settings.Timeout = config.OsRestartHooksTimeout
+	}
+	if settings.RetryDelay == 0 {
+		settings.RetryDelay = 5 * time.Second
+	}
+	return settings, nil
+}
+
+// readHookSettingsHeader parses the settings of the goahead: lines in the leading comments of the
+// script. Binaries, scripts without such comments and scripts which can not be read have no
+// settings.
+func readHookSettingsHeader(file string) (hookSettings, error) {
+	var settings hookSettings
+	f, err := os.Open(file)
+	if err != nil {
+		// a hook which can not be read fails when it is executed
+		return settings, nil
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) > 0 && !strings.HasPrefix(line, "#") {
+			break
+		}
+		if !strings.HasPrefix(line, hookSettingsPrefix) {
+			continue
+		}
+		for _, field := range strings.Fields(strings.TrimPrefix(line, hookSettingsPrefix)) {
+			if err := settings.set(field); err != nil {
+				return settings, errors.New("Invalid goahead header in hook " + file + ": " + err.Error())
+			}
+		}
+	}
+	// a long first line without newline is a binary, which can not contain header comments
+	if err := scanner.Err(); err != nil && err != bufio.ErrTooLong {
+		return settings, errors.New("Failed to read hook " + file + " Error: " + err.Error())
+	}
+	return settings, nil
+}
+
+// set parses a single key=value setting of a goahead header comment
+func (s *hookSettings) set(field string) error {
+	key, value, found := strings.Cut(field, "=")
+	if !found {
+		return errors.New("expected key=value, found " + field)
+	}
+	var err error
+	switch key {
+	case "timeout":
+		s.Timeout, err = time.ParseDuration(value)
+	case "retries":
+		s.Retries, err = strconv.Atoi(value)
+	case "retry_delay":
+		s.RetryDelay, err = time.ParseDuration(value)
+	case "allow_fail":
+		var allowFail bool
+		allowFail, err = strconv.ParseBool(value)
+		s.AllowFail = &allowFail
+	case "after":
+		s.After = append(s.After, strings.Split(value, ",")...)
+	default:
+		return errors.New("unknown setting " + key + ", expected timeout, retries, retry_delay, allow_fail or after")
+	}
+	if err != nil {
+		return errors.New("invalid value of " + key + ": " + value)
+	}
+	return nil
+}
@@ -1,42 +1,207 @@
 package main
 
 import (
+	"encoding/binary"
+	"errors"
+	"flag"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/xorpaul/goahead_client/goahead"
 	h "github.com/xorpaul/gohelper"
 )
 
-func getPayloadFqdn() string {
+// bootIDFile contains the random ID the kernel generates on each boot
+var bootIDFile = "/proc/sys/kernel/random/boot_id"
+
+// the files read by the facts collectors
+var (
+	osReleaseFile = "/etc/os-release"
+	machineIDFile = "/etc/machine-id"
+	utmpFile      = "/var/run/utmp"
+)
+
+// utmp records of glibc on Linux are 384 bytes long and start with the 2 byte record type
+const (
+	utmpRecordSize  = 384
+	utmpUserProcess = 7
+)
+
+func getPayloadFqdn() (string, error) {
 	if len(config.Fqdn) > 0 {
-		return config.Fqdn
-	} else {
-		hostname, err := os.Hostname()
-		if err != nil {
-			h.Fatalf("Error while getting hostname Error: " + err.Error())
+		return config.Fqdn, nil
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", errors.New("Error while getting hostname Error: " + err.Error())
+	}
+	return hostname, nil
+}
+
+func getPayloadUptime() (string, error) {
+	uptime, err := getUptime()
+	if err != nil {
+		return "", errors.New("Error while getting uptime Error: " + err.Error())
+	}
+	return uptime.String(), nil
+}
+
+// getUptime returns the uptime of the host, which is faked while running the tests
+func getUptime() (time.Duration, error) {
+	if flag.Lookup("test.v") != nil {
+		if os.Getenv("TEST_FOR_CRASH_TestUptimeLow") == "1" {
+			return time.Duration(2) * time.Second, nil
 		}
-		return hostname
+		return time.Duration(83836) * time.Second, nil
+	}
+	return goahead.ReadUptime()
+}
+
+// getBootID returns the ID of the current boot or an empty string if it is not available
+func getBootID() string {
+	dat, err := ioutil.ReadFile(bootIDFile)
+	if err != nil {
+		h.Debugf("Could not read boot ID from " + bootIDFile + " Error: " + err.Error())
+		return ""
+	}
+	return strings.TrimSpace(string(dat))
+}
+
+// getPayloadFacts collects the facts enabled in the facts settings, it returns nil if none are enabled
+func getPayloadFacts() *goahead.Facts {
+	settings := config.Facts
+	facts := &goahead.Facts{}
+	empty := true
+	if settings.Kernel {
+		facts.KernelRelease = getKernelRelease()
+		empty = empty && len(facts.KernelRelease) == 0
+	}
+	if settings.OSRelease {
+		facts.OSRelease = getOSRelease()
+		empty = empty && facts.OSRelease == nil
+	}
+	if settings.BootID {
+		facts.BootID = getBootID()
+		empty = empty && len(facts.BootID) == 0
+	}
+	if settings.LoadAverage {
+		facts.LoadAverage = getLoadAverage()
+		empty = empty && len(facts.LoadAverage) == 0
 	}
+	if settings.Users {
+		facts.Users = getLoggedInUsers()
+		empty = empty && facts.Users == nil
+	}
+	if settings.MachineID {
+		facts.MachineID = getMachineID()
+		empty = empty && len(facts.MachineID) == 0
+	}
+	if len(settings.Labels) > 0 {
+		facts.Labels = settings.Labels
+		empty = false
+	}
+	if empty {
+		return nil
+	}
+	return facts
 }
 
-func getPayloadUptime() string {
-	dat, err := ioutil.ReadFile("/proc/uptime")
+// getKernelRelease returns the release of the running kernel
+func getKernelRelease() string {
+	osrelease := filepath.Join(procDir, "sys/kernel/osrelease")
+	dat, err := os.ReadFile(osrelease)
 	if err != nil {
-		h.Fatalf("Error while trying to open /proc/uptime. Error: " + err.Error())
+		h.Debugf("Could not read kernel release from " + osrelease + " Error: " + err.Error())
+		return ""
 	}
-	times := strings.Fields(string(dat))
-	uptimeSeconds := strings.Split(times[0], ".")[0]
+	return strings.TrimSpace(string(dat))
+}
+
+// getOSRelease parses the identifying fields of /etc/os-release
+func getOSRelease() *goahead.OSRelease {
+	dat, err := os.ReadFile(osReleaseFile)
 	if err != nil {
-		h.Fatalf("Error while trying to ParseFloat uptime. Error: " + err.Error())
+		h.Debugf("Could not read " + osReleaseFile + " Error: " + err.Error())
+		return nil
 	}
-	uptime, err := time.ParseDuration(uptimeSeconds + "s")
+	osRelease := &goahead.OSRelease{}
+	for _, line := range strings.Split(string(dat), "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), "=")
+		if !found || strings.HasPrefix(key, "#") {
+			continue
+		}
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else {
+			value = strings.Trim(value, "'\"")
+		}
+		switch key {
+		case "ID":
+			osRelease.ID = value
+		case "VERSION_ID":
+			osRelease.VersionID = value
+		case "VERSION_CODENAME":
+			osRelease.VersionCodename = value
+		case "PRETTY_NAME":
+			osRelease.PrettyName = value
+		}
+	}
+	return osRelease
+}
+
+// getLoadAverage returns the load average of the last 1, 5 and 15 minutes
+func getLoadAverage() []float64 {
+	loadavg := filepath.Join(procDir, "loadavg")
+	dat, err := os.ReadFile(loadavg)
 	if err != nil {
-		h.Fatalf("Error while trying to parse uptime to Duration. Error: " + err.Error())
+		h.Debugf("Could not read load average from " + loadavg + " Error: " + err.Error())
+		return nil
+	}
+	fields := strings.Fields(string(dat))
+	if len(fields) < 3 {
+		h.Debugf("Could not parse load average from " + loadavg + ": " + string(dat))
+		return nil
 	}
+	var load []float64
+	for _, field := range fields[:3] {
+		value, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			h.Debugf("Could not parse load average from " + loadavg + ": " + string(dat))
+			return nil
+		}
+		load = append(load, value)
+	}
+	return load
+}
+
+// getLoggedInUsers counts the user sessions in the utmp file like who(1) does
+func getLoggedInUsers() *int {
+	dat, err := os.ReadFile(utmpFile)
+	if err != nil {
+		h.Debugf("Could not read logged in users from " + utmpFile + " Error: " + err.Error())
+		return nil
+	}
+	users := 0
+	for offset := 0; offset+utmpRecordSize <= len(dat); offset += utmpRecordSize {
+		if binary.NativeEndian.Uint16(dat[offset:]) == utmpUserProcess {
+			users++
+		}
+	}
+	return &users
+}
 
-	return uptime.String()
+// getMachineID returns the unique ID of the installation from /etc/machine-id
+func getMachineID() string {
+	dat, err := os.ReadFile(machineIDFile)
+	if err != nil {
+		h.Debugf("Could not read machine ID from " + machineIDFile + " Error: " + err.Error())
+		return ""
+	}
+	return strings.TrimSpace(string(dat))
 }
 
 func secondsToTime(time int) (int, int, int) {
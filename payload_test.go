@@ -0,0 +1,67 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/xorpaul/goahead_client/goahead"
+)
+
+// useFactsFixtures points the facts collectors to the given directory
+func useFactsFixtures(t *testing.T, root string) {
+	savedPaths := []string{osReleaseFile, machineIDFile, utmpFile, bootIDFile, procDir}
+	t.Cleanup(func() {
+		osReleaseFile, machineIDFile, utmpFile, bootIDFile, procDir = savedPaths[0], savedPaths[1], savedPaths[2], savedPaths[3], savedPaths[4]
+	})
+	osReleaseFile = filepath.Join(root, "etc/os-release")
+	machineIDFile = filepath.Join(root, "etc/machine-id")
+	utmpFile = filepath.Join(root, "var/run/utmp")
+	bootIDFile = filepath.Join(root, "proc/sys/kernel/random/boot_id")
+	procDir = filepath.Join(root, "proc")
+}
+
+func TestGetPayloadFacts(t *testing.T) {
+	savedConfig := config
+	defer func() { config = savedConfig }()
+	useFactsFixtures(t, "./tests/TestFacts")
+
+	users := 2
+	all := goahead.Facts{
+		KernelRelease: "6.1.0-13-amd64",
+		OSRelease:     &goahead.OSRelease{ID: "debian", VersionID: "12", VersionCodename: "bookworm", PrettyName: "Debian GNU/Linux 12 (bookworm)"},
+		BootID:        "6f1c2f1c-5d4a-4a8e-9a55-0d6c1b0b2b11",
+		LoadAverage:   []float64{0.52, 0.58, 0.59},
+		Users:         &users,
+		MachineID:     "4f9c3e2a1b8d4c6e9f0a7b5c3d2e1f00",
+		Labels:        map[string]string{"rack": "r12", "role": "db"},
+	}
+	tests := []struct {
+		name     string
+		settings factsSettings
+		expected *goahead.Facts
+	}{
+		{"disabled", factsSettings{}, nil},
+		{"kernel", factsSettings{Kernel: true}, &goahead.Facts{KernelRelease: all.KernelRelease}},
+		{"os_release", factsSettings{OSRelease: true}, &goahead.Facts{OSRelease: all.OSRelease}},
+		{"boot_id", factsSettings{BootID: true}, &goahead.Facts{BootID: all.BootID}},
+		{"load_average", factsSettings{LoadAverage: true}, &goahead.Facts{LoadAverage: all.LoadAverage}},
+		{"users", factsSettings{Users: true}, &goahead.Facts{Users: all.Users}},
+		{"machine_id", factsSettings{MachineID: true}, &goahead.Facts{MachineID: all.MachineID}},
+		{"labels", factsSettings{Labels: all.Labels}, &goahead.Facts{Labels: all.Labels}},
+		{"all", factsSettings{true, true, true, true, true, true, all.Labels}, &all},
+	}
+	for _, test := range tests {
+		config.Facts = test.settings
+		if facts := getPayloadFacts(); !reflect.DeepEqual(facts, test.expected) {
+			t.Errorf("%s: collected facts %+v, but we expected %+v", test.name, facts, test.expected)
+		}
+	}
+
+	// facts which can not be collected are left out
+	useFactsFixtures(t, t.TempDir())
+	config.Facts = factsSettings{true, true, true, true, true, true, nil}
+	if facts := getPayloadFacts(); facts != nil {
+		t.Errorf("collected facts %+v from an empty directory, but we expected none", facts)
+	}
+}
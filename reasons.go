@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/xorpaul/goahead_client/goahead"
+)
+
+// parseRestartReason creates the restart reason from the output of a restart condition script. If the
+// script printed a JSON object, its fields are forwarded, otherwise the output is used as sanitized text.
+func parseRestartReason(source string, output string) goahead.RestartReason {
+	reason := goahead.RestartReason{Source: source}
+	trimmed := strings.TrimSpace(output)
+	if strings.HasPrefix(trimmed, "{") && json.Unmarshal([]byte(trimmed), &reason) == nil {
+		if len(reason.Source) == 0 {
+			reason.Source = source
+		}
+		reason.Source = sanitizeReason(reason.Source, 128)
+		reason.Type = sanitizeReason(reason.Type, 128)
+		reason.Severity = sanitizeReason(reason.Severity, 128)
+		reason.Reason = sanitizeReason(reason.Reason, config.RestartReasonMaxLength)
+		for i := range reason.Packages {
+			reason.Packages[i] = sanitizeReason(reason.Packages[i], 256)
+		}
+		for i := range reason.CVEs {
+			reason.CVEs[i] = sanitizeReason(reason.CVEs[i], 64)
+		}
+		return reason
+	}
+	reason.Reason = sanitizeReason(output, config.RestartReasonMaxLength)
+	return reason
+}
+
+// sanitizeReason replaces invalid UTF-8, newlines and other control characters with single spaces and
+// truncates the text to maxLength characters
+func sanitizeReason(text string, maxLength int) string {
+	text = strings.ToValidUTF8(text, " ")
+	var b strings.Builder
+	space := false
+	for _, r := range text {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			space = true
+			continue
+		}
+		if space && b.Len() > 0 {
+			b.WriteRune(' ')
+		}
+		space = false
+		b.WriteRune(r)
+	}
+	sanitized := b.String()
+	if maxLength > 0 && utf8.RuneCountInString(sanitized) > maxLength {
+		runes := []rune(sanitized)
+		if maxLength > 3 {
+			sanitized = string(runes[:maxLength-3]) + "..."
+		} else {
+			sanitized = string(runes[:maxLength])
+		}
+	}
+	return sanitized
+}
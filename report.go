@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/xorpaul/goahead_client/goahead"
+	h "github.com/xorpaul/gohelper"
+)
+
+// restartReportedStatus marks a granted restart which was confirmed to the goahead service
+const restartReportedStatus = "reported"
+
+// restartCompleted checks if the host was restarted since the restart was granted, either by a
+// changed boot ID or by an uptime lower than the one recorded before the restart
+func restartCompleted(state restartState, bootID string, uptime string) bool {
+	if len(state.BootID) > 0 && len(bootID) > 0 {
+		return state.BootID != bootID
+	}
+	previousUptime, err := time.ParseDuration(state.Uptime)
+	if err != nil {
+		h.Debugf("Could not parse uptime " + state.Uptime + " from state file. Error: " + err.Error())
+		return false
+	}
+	currentUptime, err := time.ParseDuration(uptime)
+	if err != nil {
+		h.Debugf("Could not parse current uptime " + uptime + " Error: " + err.Error())
+		return false
+	}
+	return currentUptime < previousUptime
+}
+
+// reportRestartDone confirms a completed restart to the goahead service, so that the service can
+// release the cluster lock. If the report fails it is tried again during the next run.
+func reportRestartDone(ctx context.Context) {
+	state, err := readRestartState(config.StateFile)
+	if err != nil {
+		h.Infof("Ignoring state file: " + err.Error())
+		return
+	}
+	if state.Status != restartGranted.String() {
+		return
+	}
+	bootID := getBootID()
+	uptime, err := getPayloadUptime()
+	if err != nil {
+		h.Infof("Could not check if the granted restart was completed, trying again during the next run. " + err.Error())
+		return
+	}
+	if !restartCompleted(state, bootID, uptime) {
+		h.Debugf("Granted restart with request_id " + state.RequestID + " was not completed yet")
+		return
+	}
+
+	healthChecks, err := runPostRestartChecks(ctx)
+	if err != nil {
+		h.Infof("Could not run post restart checks, trying again during the next run. Error: " + err.Error())
+		return
+	}
+	h.Infof("Reporting completed restart with request_id " + state.RequestID + " to goahead service")
+	report := goahead.RestartDoneReport{
+		RequestID:      state.RequestID,
+		RestartReason:  state.RestartReason,
+		RestartReasons: state.RestartReasons,
+		PreviousUptime: state.Uptime,
+		Uptime:         uptime,
+		PreviousBootID: state.BootID,
+		BootID:         bootID,
+		RequestedAt:    state.RequestedAt,
+		GrantedAt:      state.GrantedAt,
+		HealthChecks:   healthChecks,
+	}
+	// the server which granted the restart holds the cluster lock
+	c := client
+	if len(state.ServiceURL) > 0 {
+		c = client.WithServiceURL(state.ServiceURL)
+	}
+	if _, err := c.ReportRestartDone(ctx, report); err != nil {
+		h.Infof("Could not report completed restart, trying again during the next run. Error: " + err.Error())
+		return
+	}
+
+	state.Status = restartReportedStatus
+	state.ReportedAt = time.Now()
+	saveRestartState(state)
+}
+
+// reportRestartAborted records the status of the granted restart in the state file and tells the
+// goahead service that the restart was aborted, so that it can release the cluster lock
+func reportRestartAborted(ctx context.Context, response goahead.Response, report goahead.RestartAbortedReport, status string) {
+	report.RequestID = response.RequestID
+	report.AbortedAt = time.Now()
+	state, err := readRestartState(config.StateFile)
+	if err != nil {
+		h.Infof("Ignoring state file: " + err.Error())
+	} else if state.RequestID == response.RequestID {
+		report.RestartReason = state.RestartReason
+		report.RestartReasons = state.RestartReasons
+		state.Status = status
+		state.UpdatedAt = time.Now()
+		saveRestartState(state)
+	}
+
+	h.Infof("Reporting aborted restart with request_id " + response.RequestID + " to goahead service")
+	// the server which granted the restart holds the cluster lock
+	c := client
+	if len(response.ServiceURL) > 0 {
+		c = client.WithServiceURL(response.ServiceURL)
+	}
+	if _, err := c.ReportRestartAborted(ctx, report); err != nil {
+		h.Infof("Could not report aborted restart. Error: " + err.Error())
+	}
+}
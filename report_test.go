@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRestartCompleted(t *testing.T) {
+	tests := []struct {
+		name     string
+		state    restartState
+		bootID   string
+		uptime   string
+		expected bool
+	}{
+		{"boot ID changed", restartState{BootID: "old", Uptime: "1h"}, "new", "2h", true},
+		{"same boot ID", restartState{BootID: "old", Uptime: "2h"}, "old", "1h", false},
+		{"lower uptime without boot ID", restartState{Uptime: "23h17m16s"}, "", "5m", true},
+		{"higher uptime without boot ID", restartState{Uptime: "5m"}, "", "5m30s", false},
+		{"unparsable uptime", restartState{Uptime: "foobar"}, "", "5m", false},
+	}
+	for _, test := range tests {
+		if completed := restartCompleted(test.state, test.bootID, test.uptime); completed != test.expected {
+			t.Errorf("%s: restartCompleted() returned %v, but we expected %v", test.name, completed, test.expected)
+		}
+	}
+}
+
+func TestReportRestartDone(t *testing.T) {
+	savedConfig := config
+	savedClient := client
+	defer func() {
+		config = savedConfig
+		client = savedClient
+	}()
+	config.StateFile = filepath.Join(t.TempDir(), "state.json")
+	fakeMutex.Lock()
+	fakeReports = nil
+	fakeMutex.Unlock()
+
+	granted := restartState{
+		RequestID:     "sqEALyco",
+		RestartReason: "testing",
+		Status:        "granted",
+		BootID:        "6f1c2f1c-5d4a-4a8e-9a55-0d6c1b0b2b11",
+		Uptime:        "87600h0m0s",
+		RequestedAt:   time.Now().Add(-time.Hour),
+		GrantedAt:     time.Now().Add(-50 * time.Minute),
+	}
+	if err := writeRestartState(config.StateFile, granted); err != nil {
+		t.Fatal(err)
+	}
+
+	// an unreachable service keeps the state to try again during the next run
+	config.ServiceUrl = "http://127.0.0.1:1/"
+	config.RequestRetries = -1
+	client = setupClient()
+	reportRestartDone(context.Background())
+	state, _ := readRestartState(config.StateFile)
+	if state.Status != "granted" {
+		t.Errorf("state has status %s after a failed report, but we expected granted", state.Status)
+	}
+
+	client = savedClient
+	reportRestartDone(context.Background())
+	state, _ = readRestartState(config.StateFile)
+	if state.Status != restartReportedStatus || state.ReportedAt.IsZero() {
+		t.Errorf("state has status %s after the report, but we expected %s", state.Status, restartReportedStatus)
+	}
+
+	// the restart is only reported once
+	reportRestartDone(context.Background())
+
+	fakeMutex.Lock()
+	defer fakeMutex.Unlock()
+	if len(fakeReports) != 1 {
+		t.Fatalf("service received %d reports, but we expected 1", len(fakeReports))
+	}
+	report := fakeReports[0]
+	if report.RequestID != "sqEALyco" || report.PreviousUptime != "87600h0m0s" || report.PreviousBootID != granted.BootID || report.RestartReason != "testing" {
+		t.Errorf("service received report %+v, which does not match the granted restart %+v", report, granted)
+	}
+	if report.Fqdn != "foobar-server-aa02.domain.tld" || len(report.Uptime) == 0 {
+		t.Errorf("service received report %+v without fqdn or uptime", report)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xorpaul/goahead_client/goahead"
+	h "github.com/xorpaul/gohelper"
+)
+
+// restartActionSettings configures the built-in restart_action, which restarts the host after all
+// restart hooks succeeded
+type restartActionSettings struct {
+	// Type is one of the restartActions, an empty type leaves the restart to the restart hooks
+	Type    string `yaml:"type"`
+	Command string `yaml:"command"`
+	// Delay is waited after the wall message was sent
+	Delay       time.Duration `yaml:"delay"`
+	WallMessage string        `yaml:"wall_message"`
+	Timeout     time.Duration `yaml:"timeout"`
+}
+
+// restartActions are the built-in ways to restart the host which can be selected via restart_action.
+// Each action returns the result of the command which triggered the restart.
+var restartActions = map[string]func(ctx context.Context, settings restartActionSettings) scriptResult{
+	"systemd":   restartViaLogind,
+	"systemctl": restartViaSystemctl,
+	"kexec":     restartViaKexec,
+	"command":   restartViaCommand,
+}
+
+// wallCommand sends the wall_message to all logged in users
+var wallCommand = "wall"
+
+// executeRestartAction sends the wall message, waits for the delay and executes the restart_action.
+// It returns false if the restart_action failed.
+func executeRestartAction(ctx context.Context, response goahead.Response) (scriptResult, bool) {
+	settings := config.RestartAction
+	if len(settings.Type) == 0 {
+		return scriptResult{}, true
+	}
+	if len(settings.WallMessage) > 0 {
+		message := expandWallMessage(settings.WallMessage, response)
+		if wr := runArgs(ctx, settings.Timeout, wallCommand, message); wr.Err != nil || wr.ReturnCode != 0 {
+			// a missing wall message must not stop the restart
+			h.Infof("Failed to send wall message with " + wallCommand + " exit code " + strconv.Itoa(wr.ReturnCode) + " Output: " + wr.Output)
+		}
+	}
+	if settings.Delay > 0 {
+		h.Infof("Executing restart_action " + settings.Type + " in " + settings.Delay.String())
+		select {
+		case <-time.After(settings.Delay):
+		case <-ctx.Done():
+			return scriptResult{Script: settings.Type, ReturnCode: -1, Err: errors.New("aborted during the restart_action delay")}, false
+		}
+	}
+	h.Infof("Executing restart_action " + settings.Type)
+	result := restartActions[settings.Type](ctx, settings)
+	if result.Err != nil {
+		result.Output = result.Err.Error() + " " + result.Output
+	}
+	return result, result.Err == nil && result.ReturnCode == 0
+}
+
+// expandWallMessage replaces the placeholders {delay}, {request_id}, {reason} and {cluster} of the
+// wall_message
+func expandWallMessage(message string, response goahead.Response) string {
+	return strings.NewReplacer(
+		"{delay}", config.RestartAction.Delay.String(),
+		"{request_id}", response.RequestID,
+		"{reason}", grantedRestartReason(response),
+		"{cluster}", response.FoundCluster,
+	).Replace(message)
+}
+
+// grantedRestartReason returns the restart reason of the granted restart from the state file, or
+// an empty string if the state file belongs to another restart request
+func grantedRestartReason(response goahead.Response) string {
+	if len(response.RequestID) == 0 {
+		return ""
+	}
+	if state, err := readRestartState(config.StateFile); err == nil && state.RequestID == response.RequestID {
+		return sanitizeReason(state.RestartReason, 0)
+	}
+	return ""
+}
+
+// restartViaLogind asks systemd-logind via D-Bus to reboot the host, which also honors inhibitors
+func restartViaLogind(ctx context.Context, settings restartActionSettings) scriptResult {
+	return runArgs(ctx, settings.Timeout, "busctl", "call", "org.freedesktop.login1", "/org/freedesktop/login1", "org.freedesktop.login1.Manager", "Reboot", "b", "false")
+}
+
+// restartViaSystemctl reboots the host with systemctl reboot
+func restartViaSystemctl(ctx context.Context, settings restartActionSettings) scriptResult {
+	return runArgs(ctx, settings.Timeout, "systemctl", "reboot")
+}
+
+// restartViaKexec loads the newest installed kernel and boots into it without a firmware restart
+func restartViaKexec(ctx context.Context, settings restartActionSettings) scriptResult {
+	args, err := kexecLoadArguments()
+	if err != nil {
+		return scriptResult{Script: "kexec", ReturnCode: -1, Err: err}
+	}
+	if result := runArgs(ctx, settings.Timeout, "kexec", args...); result.Err != nil || result.ReturnCode != 0 {
+		return result
+	}
+	return runArgs(ctx, settings.Timeout, "systemctl", "kexec")
+}
+
+// kexecLoadArguments returns the arguments of kexec to load the newest kernel of /boot with its
+// initrd and the command line of the running kernel
+func kexecLoadArguments() ([]string, error) {
+	version := newestKernel()
+	if len(version) == 0 {
+		return nil, errors.New("Could not find any installed kernels in " + bootDir)
+	}
+	args := []string{"--load", filepath.Join(bootDir, "vmlinuz-"+version)}
+	for _, initrd := range []string{"initrd.img-" + version, "initramfs-" + version + ".img"} {
+		if _, err := os.Stat(filepath.Join(bootDir, initrd)); err == nil {
+			args = append(args, "--initrd="+filepath.Join(bootDir, initrd))
+			break
+		}
+	}
+	return append(args, "--reuse-cmdline"), nil
+}
+
+// restartViaCommand executes the configured command with /bin/sh
+func restartViaCommand(ctx context.Context, settings restartActionSettings) scriptResult {
+	return runArgs(ctx, settings.Timeout, "/bin/sh", "-c", settings.Command)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xorpaul/goahead_client/goahead"
+)
+
+// useFakeRestartActions registers the restart actions fake and fake_failing, which only log their
+// execution to $GOAHEAD_TEST_OUTPUT, and replaces wall with tests/fake-wall.sh
+func useFakeRestartActions(t *testing.T) {
+	savedWallCommand := wallCommand
+	t.Cleanup(func() {
+		delete(restartActions, "fake")
+		delete(restartActions, "fake_failing")
+		wallCommand = savedWallCommand
+	})
+	wallCommand = "./tests/fake-wall.sh"
+	logAction := func(name string) {
+		f, err := os.OpenFile(os.Getenv("GOAHEAD_TEST_OUTPUT"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		f.WriteString("restart_action " + name + "\n")
+	}
+	restartActions["fake"] = func(ctx context.Context, settings restartActionSettings) scriptResult {
+		logAction("fake")
+		return scriptResult{Script: "fake"}
+	}
+	restartActions["fake_failing"] = func(ctx context.Context, settings restartActionSettings) scriptResult {
+		logAction("fake_failing")
+		return scriptResult{Script: "fake_failing", ReturnCode: 1, Output: "reboot refused"}
+	}
+}
+
+func TestRestartAction(t *testing.T) {
+	savedConfig := config
+	defer func() { config = savedConfig }()
+	useFakeRestartActions(t)
+	config.OsRestartHooksDir = "./tests/TestRestartHookPhases/"
+	config.StateFile = filepath.Join(t.TempDir(), "state.json")
+	config.RestartAction = restartActionSettings{Type: "fake", Delay: 10 * time.Millisecond, Timeout: time.Second, WallMessage: "goahead: restarting in {delay} because of {reason} ({request_id} {cluster})"}
+	output := filepath.Join(t.TempDir(), "hooks.log")
+	t.Setenv("GOAHEAD_TEST_OUTPUT", output)
+
+	granted := restartState{RequestID: "sqEALyco", RestartReason: "kernel update\nlibc update", Status: "granted"}
+	if err := writeRestartState(config.StateFile, granted); err != nil {
+		t.Fatal(err)
+	}
+	response := goahead.Response{RequestID: "sqEALyco", Goahead: true, FoundCluster: "foobar-server"}
+	start := time.Now()
+	if exitCode := executeRestartHooks(context.Background(), response); exitCode != exitCodeOK {
+		t.Errorf("executeRestartHooks returned exit code %d, but we expected %d", exitCode, exitCodeOK)
+	}
+	if time.Since(start) < config.RestartAction.Delay {
+		t.Errorf("restart_action was executed before its delay of %s", config.RestartAction.Delay)
+	}
+	expected := []string{"pre_restart 010_drain.sh", "pre_restart 020_silence_monitoring.sh", "restart 999_restart.sh",
+		"wall goahead: restarting in 10ms because of kernel update libc update (sqEALyco foobar-server)", "restart_action fake"}
+	if lines := readHookOutput(t, output); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("hooks were executed in order %q, but we expected %q", lines, expected)
+	}
+}
+
+func TestRestartActionFailing(t *testing.T) {
+	savedConfig := config
+	defer func() { config = savedConfig }()
+	useFakeRestartActions(t)
+	config.OsRestartHooksDir = "./tests/TestRestartHookPhases/"
+	config.StateFile = filepath.Join(t.TempDir(), "state.json")
+	config.RestartAction = restartActionSettings{Type: "fake_failing", Timeout: time.Second}
+	output := filepath.Join(t.TempDir(), "hooks.log")
+	t.Setenv("GOAHEAD_TEST_OUTPUT", output)
+	fakeMutex.Lock()
+	fakeAbortReports = nil
+	fakeMutex.Unlock()
+
+	response := goahead.Response{RequestID: "sqEALyco", Goahead: true, ServiceURL: ts.URL + "/"}
+	if exitCode := executeRestartHooks(context.Background(), response); exitCode != exitCodeRestartHooksFailed {
+		t.Errorf("executeRestartHooks returned exit code %d, but we expected %d", exitCode, exitCodeRestartHooksFailed)
+	}
+	expected := []string{"pre_restart 010_drain.sh", "pre_restart 020_silence_monitoring.sh", "restart 999_restart.sh", "restart_action fake_failing", "on_abort 010_undrain.sh"}
+	if lines := readHookOutput(t, output); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("hooks were executed in order %q, but we expected %q", lines, expected)
+	}
+
+	fakeMutex.Lock()
+	defer fakeMutex.Unlock()
+	if len(fakeAbortReports) != 1 || fakeAbortReports[0].Phase != "restart_action" || fakeAbortReports[0].FailedHook != "fake_failing" || fakeAbortReports[0].Output != "reboot refused" {
+		t.Errorf("service received abort reports %+v, but we expected one for the restart_action", fakeAbortReports)
+	}
+}
+
+func TestKexecLoadArguments(t *testing.T) {
+	useDetectorFixtures(t, "./tests/TestDetectors")
+	args, err := kexecLoadArguments()
+	expected := []string{"--load", "tests/TestDetectors/boot/vmlinuz-5.10.0-21-amd64", "--initrd=tests/TestDetectors/boot/initrd.img-5.10.0-21-amd64", "--reuse-cmdline"}
+	if err != nil || !reflect.DeepEqual(args, expected) {
+		t.Errorf("kexecLoadArguments returned %q %v, but we expected %q", args, err, expected)
+	}
+
+	bootDir = t.TempDir()
+	if _, err := kexecLoadArguments(); err == nil {
+		t.Errorf("kexecLoadArguments did not fail without installed kernels")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	h "github.com/xorpaul/gohelper"
+)
+
+// scriptResult is the result of a single script execution
+type scriptResult struct {
+	Script     string
+	ReturnCode int
+	Output     string
+	Duration   time.Duration
+	// Err is set if the script could not be executed or was killed, ReturnCode is -1 then
+	Err error
+}
+
+// runScript executes the script and kills it if it is still running after the timeout. Unlike
+// h.ExecuteCommand it keeps the real exit code of the script.
+func runScript(ctx context.Context, script string, timeout time.Duration) scriptResult {
+	return runArgs(ctx, timeout, script)
+}
+
+// scriptOptions are the settings of a script execution
+type scriptOptions struct {
+	// Timeout kills the script if it is still running, 0 disables the timeout
+	Timeout time.Duration
+	// Env is added to the environment of the goahead client
+	Env []string
+	// Stdin is passed to the script on standard input
+	Stdin []byte
+}
+
+// runArgs executes the command with the arguments like runScript
+func runArgs(ctx context.Context, timeout time.Duration, name string, args ...string) scriptResult {
+	return executeScript(ctx, scriptOptions{Timeout: timeout}, name, args...)
+}
+
+// executeScript executes the command with the arguments and the options
+func executeScript(ctx context.Context, options scriptOptions, name string, args ...string) scriptResult {
+	script := strings.Join(append([]string{name}, args...), " ")
+	h.Debugf("Executing " + script)
+	timeout := options.Timeout
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if len(options.Env) > 0 {
+		cmd.Env = append(os.Environ(), options.Env...)
+	}
+	if options.Stdin != nil {
+		cmd.Stdin = bytes.NewReader(options.Stdin)
+	}
+	// do not wait for children which keep the output pipes open after the script was killed
+	cmd.WaitDelay = time.Second
+
+	start := time.Now()
+	err := cmd.Run()
+	result := scriptResult{Script: script, Output: output.String(), Duration: time.Since(start)}
+	h.Debugf("Executing " + script + " took " + strconv.FormatFloat(result.Duration.Seconds(), 'f', 5, 64) + "s")
+
+	var exitErr *exec.ExitError
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		result.ReturnCode = -1
+		result.Err = errors.New("killed after timeout of " + timeout.String())
+	case ctx.Err() != nil:
+		result.ReturnCode = -1
+		result.Err = errors.New("aborted")
+	case errors.As(err, &exitErr):
+		result.ReturnCode = exitErr.ExitCode()
+	case err != nil:
+		result.ReturnCode = -1
+		result.Err = err
+	}
+	return result
+}
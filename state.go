@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/xorpaul/goahead_client/goahead"
+	h "github.com/xorpaul/gohelper"
+)
+
+// restartState is the local state of the last restart negotiation, which is persisted in the
+// configured state_file to be able to continue the negotiation after the client was killed
+type restartState struct {
+	RequestID      string                  `json:"request_id"`
+	ServiceURL     string                  `json:"service_url,omitempty"`
+	RestartReason  string                  `json:"restart_reason"`
+	RestartReasons []goahead.RestartReason `json:"restart_reasons,omitempty"`
+	Status         string                  `json:"status"`
+	BootID         string                  `json:"boot_id,omitempty"`
+	Uptime         string                  `json:"uptime"`
+	RequestedAt    time.Time               `json:"requested_at"`
+	UpdatedAt      time.Time               `json:"updated_at"`
+	GrantedAt      time.Time               `json:"granted_at"`
+	ReportedAt     time.Time               `json:"reported_at"`
+	LastResponse   *goahead.Response       `json:"last_response,omitempty"`
+}
+
+// resumable checks if the negotiation did not receive a final answer from the goahead service yet,
+// is not older than state_max_age and the host was not restarted in the meantime
+func (s restartState) resumable(bootID string) bool {
+	if len(s.RequestID) == 0 {
+		return false
+	}
+	switch s.Status {
+	case restartPending.String(), restartDeadlineExceeded.String(), restartMaxAttemptsReached.String(), restartAborted.String():
+	default:
+		return false
+	}
+	if time.Since(s.UpdatedAt) > config.StateMaxAge {
+		return false
+	}
+	if len(s.BootID) > 0 && len(bootID) > 0 && s.BootID != bootID {
+		return false
+	}
+	return true
+}
+
+// recordResponse updates the state with the response of the goahead service
+func (s *restartState) recordResponse(response goahead.Response) {
+	if len(response.RequestID) > 0 {
+		s.RequestID = response.RequestID
+		// stick to the server that issued the request_id for the whole negotiation
+		if len(s.ServiceURL) == 0 {
+			s.ServiceURL = response.ServiceURL
+		}
+	}
+	s.UpdatedAt = time.Now()
+	s.LastResponse = &response
+}
+
+// resumeRestartState returns the persisted negotiation if it can be continued or a new one
+func resumeRestartState(restartReasons []goahead.RestartReason) restartState {
+	restartReason := goahead.JoinRestartReasons(restartReasons)
+	bootID := getBootID()
+	state, err := readRestartState(config.StateFile)
+	if dryRun {
+		// a dry run must not continue or change a real negotiation
+		h.Debugf("Dry run: not continuing a previous restart request")
+	} else if err != nil {
+		h.Infof("Ignoring state file: " + err.Error())
+	} else if state.resumable(bootID) {
+		h.Infof("Continuing previous restart request with request_id " + state.RequestID + " from " + state.RequestedAt.Format(time.RFC3339))
+		state.RestartReason = restartReason
+		state.RestartReasons = restartReasons
+		return state
+	}
+	uptime, err := getPayloadUptime()
+	if err != nil {
+		h.Infof(err.Error())
+	}
+	return restartState{
+		RestartReason:  restartReason,
+		RestartReasons: restartReasons,
+		Status:         restartPending.String(),
+		BootID:         bootID,
+		Uptime:         uptime,
+		RequestedAt:    time.Now(),
+		UpdatedAt:      time.Now(),
+	}
+}
+
+// saveRestartState persists the state, a failure is logged but does not stop the negotiation
+func saveRestartState(state restartState) {
+	if dryRun {
+		h.Debugf("Dry run: not persisting restart state")
+		return
+	}
+	if err := writeRestartState(config.StateFile, state); err != nil {
+		h.Infof("Could not persist restart state: " + err.Error())
+	}
+}
+
+// readRestartState returns an empty state if the state file does not exist yet
+func readRestartState(stateFile string) (restartState, error) {
+	var state restartState
+	if len(stateFile) == 0 {
+		return state, nil
+	}
+	data, err := os.ReadFile(stateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return state, errors.New("Failed to read state file " + stateFile + " Error: " + err.Error())
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return restartState{}, errors.New("Failed to parse state file " + stateFile + " Error: " + err.Error())
+	}
+	return state, nil
+}
+
+// writeRestartState writes the state file atomically
+func writeRestartState(stateFile string, state restartState) error {
+	if len(stateFile) == 0 {
+		return nil
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return errors.New("Failed to encode state: " + err.Error())
+	}
+	return writeFileAtomically(stateFile, data)
+}
+
+// writeFileAtomically writes and syncs the content to a temporary file in the same directory, which
+// is then renamed over the file
+func writeFileAtomically(file string, data []byte) error {
+	dir := filepath.Dir(file)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.New("Failed to create directory " + dir + " Error: " + err.Error())
+	}
+	tmpFile, err := os.CreateTemp(dir, "."+filepath.Base(file)+".*")
+	if err != nil {
+		return errors.New("Failed to create temporary file in " + dir + " Error: " + err.Error())
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return errors.New("Failed to write temporary file " + tmpFile.Name() + " Error: " + err.Error())
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return errors.New("Failed to sync temporary file " + tmpFile.Name() + " Error: " + err.Error())
+	}
+	if err := tmpFile.Close(); err != nil {
+		return errors.New("Failed to close temporary file " + tmpFile.Name() + " Error: " + err.Error())
+	}
+	if err := os.Chmod(tmpFile.Name(), 0644); err != nil {
+		return errors.New("Failed to chmod temporary file " + tmpFile.Name() + " Error: " + err.Error())
+	}
+	if err := os.Rename(tmpFile.Name(), file); err != nil {
+		return errors.New("Failed to rename temporary file to " + file + " Error: " + err.Error())
+	}
+
+	// persist the rename itself
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.New("Failed to open directory " + dir + " Error: " + err.Error())
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return errors.New("Failed to sync directory " + dir + " Error: " + err.Error())
+	}
+	return nil
+}
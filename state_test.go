@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xorpaul/goahead_client/goahead"
+)
+
+func TestWriteRestartState(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "var", "lib", "goahead")
+	stateFile := filepath.Join(dir, "state.json")
+
+	state := restartState{
+		RequestID:     "pOllAgai",
+		RestartReason: "testing",
+		Status:        "pending",
+		BootID:        "6f1c2f1c-5d4a-4a8e-9a55-0d6c1b0b2b11",
+		Uptime:        "23h17m16s",
+		RequestedAt:   time.Now().Add(-time.Minute).Round(0),
+		UpdatedAt:     time.Now().Round(0),
+		LastResponse:  &goahead.Response{RequestID: "pOllAgai", AskagainIn: "20s", FoundCluster: "foobar-server"},
+	}
+	for i := 0; i < 2; i++ {
+		if err := writeRestartState(stateFile, state); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	read, err := readRestartState(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.RequestID != state.RequestID || read.Status != state.Status || !read.UpdatedAt.Equal(state.UpdatedAt) || read.LastResponse.AskagainIn != "20s" {
+		t.Errorf("read state %+v, but we expected %+v", read, state)
+	}
+
+	// no temporary files are left behind
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("found %d files in state directory, but we expected only the state file", len(entries))
+	}
+}
+
+func TestReadRestartState(t *testing.T) {
+	dir := t.TempDir()
+
+	state, err := readRestartState(filepath.Join(dir, "missing.json"))
+	if err != nil || len(state.RequestID) > 0 {
+		t.Errorf("a missing state file should result in an empty state, got %+v and error %v", state, err)
+	}
+
+	corruptFile := filepath.Join(dir, "corrupt.json")
+	if err := os.WriteFile(corruptFile, []byte(`{"request_id": "pOll`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readRestartState(corruptFile); err == nil {
+		t.Errorf("a corrupt state file should result in an error")
+	}
+}
+
+func TestRestartStateResumable(t *testing.T) {
+	savedConfig := config
+	defer func() { config = savedConfig }()
+	config.StateMaxAge = time.Hour
+
+	bootID := "6f1c2f1c-5d4a-4a8e-9a55-0d6c1b0b2b11"
+	pending := restartState{RequestID: "pOllAgai", Status: "pending", BootID: bootID, UpdatedAt: time.Now()}
+
+	tests := []struct {
+		name     string
+		modify   func(s *restartState)
+		expected bool
+	}{
+		{"pending", func(s *restartState) {}, true},
+		{"aborted", func(s *restartState) { s.Status = "aborted" }, true},
+		{"granted", func(s *restartState) { s.Status = "granted" }, false},
+		{"denied", func(s *restartState) { s.Status = "denied" }, false},
+		{"too old", func(s *restartState) { s.UpdatedAt = time.Now().Add(-2 * time.Hour) }, false},
+		{"rebooted", func(s *restartState) { s.BootID = "0b5a1d52-1d9c-4e3c-8f6e-4a3bb1d1a9c2" }, false},
+		{"without request_id", func(s *restartState) { s.RequestID = "" }, false},
+	}
+	for _, test := range tests {
+		state := pending
+		test.modify(&state)
+		if resumable := state.resumable(bootID); resumable != test.expected {
+			t.Errorf("%s: resumable() returned %v, but we expected %v", test.name, resumable, test.expected)
+		}
+	}
+}
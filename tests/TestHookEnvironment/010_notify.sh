@@ -0,0 +1,4 @@
+#! /bin/bash
+
+echo "$GOAHEAD_PHASE $GOAHEAD_REQUEST_ID $GOAHEAD_CLUSTER $GOAHEAD_FQDN $GOAHEAD_SERVICE_URL $GOAHEAD_RESTART_REASON" >> "$GOAHEAD_TEST_OUTPUT"
+cat >> "$GOAHEAD_TEST_OUTPUT"
@@ -0,0 +1,7 @@
+#! /bin/bash
+# drains the node, which can take a few minutes
+# goahead: timeout=300s retries=2
+# goahead: allow_fail=true
+
+echo "pre_restart $(basename "$0")" >> "$GOAHEAD_TEST_OUTPUT"
+# goahead: timeout=1s is ignored after the header comments
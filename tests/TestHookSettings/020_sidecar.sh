@@ -0,0 +1,4 @@
+#! /bin/bash
+# goahead: timeout=5s retries=1
+
+echo "pre_restart $(basename "$0") $DRAIN_MODE" >> "$GOAHEAD_TEST_OUTPUT"
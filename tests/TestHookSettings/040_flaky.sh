@@ -0,0 +1,6 @@
+#! /bin/bash
+# fails on the first attempt
+# goahead: retries=2 retry_delay=10ms
+
+echo "pre_restart $(basename "$0")" >> "$GOAHEAD_TEST_OUTPUT"
+test $(grep -c "$(basename "$0")" "$GOAHEAD_TEST_OUTPUT") -gt 1
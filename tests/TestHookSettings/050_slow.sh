@@ -0,0 +1,4 @@
+#! /bin/bash
+# goahead: timeout=100ms
+
+sleep 5
@@ -0,0 +1,4 @@
+#! /bin/bash
+# goahead: timeout=soon
+
+echo "pre_restart $(basename "$0")" >> "$GOAHEAD_TEST_OUTPUT"
@@ -0,0 +1,12 @@
+#! /bin/bash
+
+# fails during the first attempt and passes afterwards
+
+marker=/var/tmp/goahead_client/post_restart_check_attempted
+if [ -e ${marker} ]; then
+  exit 0
+fi
+mkdir -p /var/tmp/goahead_client
+touch ${marker}
+echo "service not ready yet"
+exit 1
@@ -0,0 +1,3 @@
+#! /bin/bash
+# fails with an exit code other than 1 to check that the exit code of the check is kept
+exit 3
@@ -0,0 +1 @@
+../always-true.sh
\ No newline at end of file
@@ -0,0 +1,2 @@
+#! /bin/bash
+sleep 5
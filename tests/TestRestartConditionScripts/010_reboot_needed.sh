@@ -0,0 +1,3 @@
+#! /bin/bash
+echo "libssl3 was updated"
+exit 1
@@ -0,0 +1,3 @@
+#! /bin/bash
+echo '{"type":"library","severity":"high","reason":"openssl was updated","packages":["libssl3","openssl"],"cves":["CVE-2023-0286"]}'
+exit 1
@@ -0,0 +1,3 @@
+#! /bin/bash
+echo "could not query package manager"
+exit 2
@@ -0,0 +1,4 @@
+#! /bin/bash
+# goahead: after=200_b_stop_services.sh
+
+echo "$(basename "$0")" >> "$GOAHEAD_TEST_OUTPUT"
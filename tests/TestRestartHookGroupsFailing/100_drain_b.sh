@@ -0,0 +1,4 @@
+#! /bin/bash
+
+echo "could not drain b"
+exit 3
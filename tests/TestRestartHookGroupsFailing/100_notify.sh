@@ -0,0 +1,5 @@
+#! /bin/bash
+# goahead: allow_fail=true
+
+echo "$(basename "$0")" >> "$GOAHEAD_TEST_OUTPUT"
+exit 1
@@ -0,0 +1,3 @@
+#! /bin/bash
+
+echo "pre_restart $(basename "$0")" >> "$GOAHEAD_TEST_OUTPUT"
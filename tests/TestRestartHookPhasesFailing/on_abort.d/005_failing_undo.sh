@@ -0,0 +1,4 @@
+#! /bin/bash
+
+echo "on_abort $(basename "$0")" >> "$GOAHEAD_TEST_OUTPUT"
+exit 1
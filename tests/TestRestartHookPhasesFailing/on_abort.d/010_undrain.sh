@@ -0,0 +1 @@
+../../TestRestartHookPhases/on_abort.d/010_undrain.sh
\ No newline at end of file
@@ -0,0 +1 @@
+../../TestRestartHookPhases/pre_restart.d/010_drain.sh
\ No newline at end of file
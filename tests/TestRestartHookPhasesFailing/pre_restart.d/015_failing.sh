@@ -0,0 +1,5 @@
+#! /bin/bash
+
+echo "pre_restart $(basename "$0")" >> "$GOAHEAD_TEST_OUTPUT"
+echo "could not drain node"
+exit 3
@@ -0,0 +1 @@
+../../TestRestartHookPhases/pre_restart.d/020_silence_monitoring.sh
\ No newline at end of file
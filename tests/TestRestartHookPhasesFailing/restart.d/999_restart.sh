@@ -0,0 +1 @@
+../../TestRestartHookPhases/restart.d/999_restart.sh
\ No newline at end of file
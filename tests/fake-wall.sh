@@ -0,0 +1,3 @@
+#! /bin/bash
+
+echo "wall $1" >> "$GOAHEAD_TEST_OUTPUT"
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	h "github.com/xorpaul/gohelper"
+)
+
+// maintenanceWindow is an entry of maintenance_windows. It is either a weekly time range on the
+// given days from start to end, which may span midnight, or it starts at each time matched by the
+// cron expression and lasts for duration.
+type maintenanceWindow struct {
+	Days     []string      `yaml:"days"`
+	Start    string        `yaml:"start"`
+	End      string        `yaml:"end"`
+	Cron     string        `yaml:"cron"`
+	Duration time.Duration `yaml:"duration"`
+	TimeZone string        `yaml:"time_zone"`
+
+	location *time.Location
+	days     [7]bool
+	// start and end are the minutes since midnight
+	start int
+	end   int
+	cron  *cronSchedule
+}
+
+// cronSchedule contains the allowed values of the five fields of a cron expression
+type cronSchedule struct {
+	minutes  map[int]bool
+	hours    map[int]bool
+	days     map[int]bool
+	months   map[int]bool
+	weekdays map[int]bool
+	// anyDay and anyWeekday are set for a * in the day of month and day of week fields, if both
+	// fields are restricted a time matching either of them is matched like in crontab(5)
+	anyDay     bool
+	anyWeekday bool
+}
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+var monthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+
+// maintenanceWindowClosedStatus marks a granted restart which was not executed, because the
+// maintenance window closed during the negotiation
+const maintenanceWindowClosedStatus = "maintenance_window_closed"
+
+// now returns the current time for the checks of the maintenance windows and blackouts, tests
+// replace it to let a window close during the negotiation
+var now = time.Now
+
+// maxCronSearch limits the search for the next start of a cron maintenance window
+const maxCronSearch = 5 * 366 * 24 * time.Hour
+
+// parse validates the maintenance window and prepares it for the checks
+func (w *maintenanceWindow) parse() error {
+	w.location = time.Local
+	if len(w.TimeZone) > 0 {
+		location, err := time.LoadLocation(w.TimeZone)
+		if err != nil {
+			return errors.New("Unknown time_zone " + w.TimeZone + " Error: " + err.Error())
+		}
+		w.location = location
+	}
+
+	if len(w.Cron) > 0 {
+		if len(w.Days) > 0 || len(w.Start) > 0 || len(w.End) > 0 {
+			return errors.New("cron can not be combined with days, start and end")
+		}
+		if w.Duration <= 0 {
+			return errors.New("cron " + w.Cron + " needs a positive duration")
+		}
+		schedule, err := parseCron(w.Cron)
+		if err != nil {
+			return err
+		}
+		w.cron = schedule
+		return nil
+	}
+
+	if len(w.Start) == 0 || len(w.End) == 0 {
+		return errors.New("needs either cron and duration or start and end")
+	}
+	if w.Duration != 0 {
+		return errors.New("duration can only be used with cron, use start and end instead")
+	}
+	var err error
+	if w.start, err = parseTimeOfDay(w.Start); err != nil {
+		return err
+	}
+	if w.end, err = parseTimeOfDay(w.End); err != nil {
+		return err
+	}
+	if w.start == 24*60 {
+		return errors.New("start must be before 24:00, found " + w.Start)
+	}
+	if w.start == w.end {
+		return errors.New("start and end must differ, found " + w.Start)
+	}
+	if len(w.Days) == 0 {
+		for i := range w.days {
+			w.days[i] = true
+		}
+	}
+	for _, day := range w.Days {
+		from, to, isRange := strings.Cut(strings.ToLower(day), "-")
+		first := indexOf(weekdayNames, from)
+		last := first
+		if isRange {
+			last = indexOf(weekdayNames, to)
+		}
+		if first < 0 || last < 0 {
+			return errors.New("Unknown day " + day + ", expected mon, tue, wed, thu, fri, sat, sun or a range like mon-fri")
+		}
+		for i := first; ; i = (i + 1) % 7 {
+			w.days[i] = true
+			if i == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// String describes the maintenance window for log messages
+func (w maintenanceWindow) String() string {
+	description := w.Start + "-" + w.End
+	if len(w.Days) > 0 {
+		description = strings.Join(w.Days, ",") + " " + description
+	}
+	if w.cron != nil {
+		description = "cron '" + w.Cron + "' for " + w.Duration.String()
+	}
+	return description + " " + w.location.String()
+}
+
+// contains checks if the time is inside of the maintenance window
+func (w maintenanceWindow) contains(t time.Time) bool {
+	t = t.In(w.location)
+	if w.cron != nil {
+		// the window is open if it started within the last duration
+		for start := t.Truncate(time.Minute); t.Sub(start) < w.Duration; start = start.Add(-time.Minute) {
+			if w.cron.matches(start) {
+				return true
+			}
+		}
+		return false
+	}
+	minute := t.Hour()*60 + t.Minute()
+	weekday := int(t.Weekday())
+	if w.start < w.end {
+		return w.days[weekday] && minute >= w.start && minute < w.end
+	}
+	// the window spans midnight, so it belongs to the day on which it starts
+	return (w.days[weekday] && minute >= w.start) || (w.days[(weekday+6)%7] && minute < w.end)
+}
+
+// next returns the next start of the maintenance window after the time
+func (w maintenanceWindow) next(t time.Time) time.Time {
+	t = t.In(w.location)
+	if w.cron != nil {
+		return w.cron.next(t)
+	}
+	for i := 0; i <= 7; i++ {
+		day := t.AddDate(0, 0, i)
+		start := time.Date(day.Year(), day.Month(), day.Day(), w.start/60, w.start%60, 0, 0, w.location)
+		if start.After(t) && w.days[int(start.Weekday())] {
+			return start
+		}
+	}
+	return time.Time{}
+}
+
+// maintenanceWindowOpen checks if the time is inside of one of the maintenance_windows. If no window
+// is open, it also returns the next start of a maintenance window.
+func maintenanceWindowOpen(t time.Time) (bool, time.Time) {
+	if len(config.MaintenanceWindows) == 0 {
+		return true, time.Time{}
+	}
+	var next time.Time
+	for _, window := range config.MaintenanceWindows {
+		if window.contains(t) {
+			h.Debugf("Inside of maintenance window " + window.String())
+			return true, time.Time{}
+		}
+		start := window.next(t)
+		if !start.IsZero() && (next.IsZero() || start.Before(next)) {
+			next = start
+		}
+	}
+	return false, next
+}
+
+// formatNextMaintenanceWindow describes when the next maintenance window starts for log messages
+func formatNextMaintenanceWindow(next time.Time) string {
+	if next.IsZero() {
+		return "no upcoming maintenance window found"
+	}
+	return "next maintenance window starts at " + next.Format(time.RFC3339)
+}
+
+// parseTimeOfDay parses times like 02:30 and returns the minutes since midnight, 24:00 is allowed
+// as end of the day
+func parseTimeOfDay(value string) (int, error) {
+	hours, minutes, found := strings.Cut(value, ":")
+	hour, hourErr := strconv.Atoi(hours)
+	minute, minuteErr := strconv.Atoi(minutes)
+	if !found || hourErr != nil || minuteErr != nil || hour < 0 || minute < 0 || minute > 59 || hour > 24 || (hour == 24 && minute > 0) {
+		return 0, errors.New("Failed to parse time " + value + ", expected a time like 02:30")
+	}
+	return hour*60 + minute, nil
+}
+
+// parseCron parses a cron expression with the fields minute, hour, day of month, month and day of week
+func parseCron(expression string) (*cronSchedule, error) {
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, errors.New("Failed to parse cron " + expression + ", expected the 5 fields minute, hour, day of month, month and day of week")
+	}
+	schedule := &cronSchedule{anyDay: fields[2] == "*", anyWeekday: fields[4] == "*"}
+	var err error
+	if schedule.minutes, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, errors.New("Failed to parse minute of cron " + expression + ": " + err.Error())
+	}
+	if schedule.hours, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, errors.New("Failed to parse hour of cron " + expression + ": " + err.Error())
+	}
+	if schedule.days, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, errors.New("Failed to parse day of month of cron " + expression + ": " + err.Error())
+	}
+	if schedule.months, err = parseCronField(fields[3], 1, 12, monthNames); err != nil {
+		return nil, errors.New("Failed to parse month of cron " + expression + ": " + err.Error())
+	}
+	if schedule.weekdays, err = parseCronField(fields[4], 0, 7, weekdayNames); err != nil {
+		return nil, errors.New("Failed to parse day of week of cron " + expression + ": " + err.Error())
+	}
+	// 7 is another name for sunday
+	if schedule.weekdays[7] {
+		schedule.weekdays[0] = true
+	}
+	return schedule, nil
+}
+
+// parseCronField parses a comma separated list of values, ranges like 1-5 and steps like */15 or
+// 0-30/10. names are the names of the values starting at min.
+func parseCronField(field string, min int, max int, names []string) (map[int]bool, error) {
+	values := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepPart)
+			if err != nil || step < 1 {
+				return nil, errors.New("invalid step " + stepPart)
+			}
+		}
+		first, last := min, max
+		if rangePart != "*" {
+			from, to, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if first, err = parseCronValue(from, min, max, names); err != nil {
+				return nil, err
+			}
+			last = first
+			if isRange {
+				if last, err = parseCronValue(to, min, max, names); err != nil {
+					return nil, err
+				}
+			} else if hasStep {
+				last = max
+			}
+			if last < first {
+				return nil, errors.New("invalid range " + rangePart)
+			}
+		}
+		for i := first; i <= last; i += step {
+			values[i] = true
+		}
+	}
+	return values, nil
+}
+
+// parseCronValue parses a number or the name of a value of a cron field
+func parseCronValue(value string, min int, max int, names []string) (int, error) {
+	if i := indexOf(names, strings.ToLower(value)); i >= 0 {
+		// the names of the months start at 1, the names of the weekdays at 0
+		return i + min, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < min || number > max {
+		return 0, errors.New("invalid value " + value + ", expected " + strconv.Itoa(min) + "-" + strconv.Itoa(max))
+	}
+	return number, nil
+}
+
+// matches checks if the cron expression matches the minute of the time
+func (s *cronSchedule) matches(t time.Time) bool {
+	return s.minutes[t.Minute()] && s.hours[t.Hour()] && s.months[int(t.Month())] && s.matchesDay(t)
+}
+
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	day := s.days[t.Day()]
+	weekday := s.weekdays[int(t.Weekday())]
+	switch {
+	case s.anyDay && s.anyWeekday:
+		return true
+	case s.anyDay:
+		return weekday
+	case s.anyWeekday:
+		return day
+	}
+	return day || weekday
+}
+
+// next returns the first minute after the time which matches the cron expression, it skips whole
+// months, days and hours which do not match
+func (s *cronSchedule) next(t time.Time) time.Time {
+	limit := t.Add(maxCronSearch)
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for t.Before(limit) {
+		switch {
+		case !s.months[int(t.Month())]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !s.hours[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !s.minutes[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// indexOf returns the index of the value in the list or -1
+func indexOf(list []string, value string) int {
+	for i, item := range list {
+		if item == value {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceWindow(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name         string
+		window       maintenanceWindow
+		at           time.Time
+		expectedOpen bool
+		expectedNext time.Time
+	}{
+		{"weekdays inside", maintenanceWindow{Days: []string{"mon-fri"}, Start: "02:00", End: "05:00", TimeZone: "Europe/Berlin"},
+			time.Date(2026, 10, 19, 3, 0, 0, 0, berlin), true, time.Date(2026, 10, 20, 2, 0, 0, 0, berlin)},
+		{"weekdays end is excluded", maintenanceWindow{Days: []string{"mon-fri"}, Start: "02:00", End: "05:00", TimeZone: "Europe/Berlin"},
+			time.Date(2026, 10, 19, 5, 0, 0, 0, berlin), false, time.Date(2026, 10, 20, 2, 0, 0, 0, berlin)},
+		{"weekdays across the change to winter time", maintenanceWindow{Days: []string{"mon-fri"}, Start: "02:00", End: "05:00", TimeZone: "Europe/Berlin"},
+			time.Date(2026, 10, 24, 3, 0, 0, 0, berlin), false, time.Date(2026, 10, 26, 2, 0, 0, 0, berlin)},
+		{"time zone of the window", maintenanceWindow{Days: []string{"mon-fri"}, Start: "02:00", End: "05:00", TimeZone: "Europe/Berlin"},
+			time.Date(2026, 10, 19, 1, 30, 0, 0, time.UTC), true, time.Date(2026, 10, 20, 2, 0, 0, 0, berlin)},
+		{"every day", maintenanceWindow{Start: "12:00", End: "13:00", TimeZone: "UTC"},
+			time.Date(2026, 10, 18, 12, 59, 0, 0, time.UTC), true, time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)},
+		{"over midnight before midnight", maintenanceWindow{Days: []string{"sat"}, Start: "22:00", End: "04:00", TimeZone: "UTC"},
+			time.Date(2026, 10, 24, 23, 0, 0, 0, time.UTC), true, time.Date(2026, 10, 31, 22, 0, 0, 0, time.UTC)},
+		{"over midnight after midnight", maintenanceWindow{Days: []string{"sat"}, Start: "22:00", End: "04:00", TimeZone: "UTC"},
+			time.Date(2026, 10, 25, 1, 0, 0, 0, time.UTC), true, time.Date(2026, 10, 31, 22, 0, 0, 0, time.UTC)},
+		{"over midnight on the wrong day", maintenanceWindow{Days: []string{"sat"}, Start: "22:00", End: "04:00", TimeZone: "UTC"},
+			time.Date(2026, 10, 24, 1, 0, 0, 0, time.UTC), false, time.Date(2026, 10, 24, 22, 0, 0, 0, time.UTC)},
+		{"until the end of the day", maintenanceWindow{Days: []string{"sun", "sat"}, Start: "20:00", End: "24:00", TimeZone: "UTC"},
+			time.Date(2026, 10, 18, 23, 59, 0, 0, time.UTC), true, time.Date(2026, 10, 24, 20, 0, 0, 0, time.UTC)},
+		{"cron inside", maintenanceWindow{Cron: "0 3 * * sat", Duration: 2 * time.Hour, TimeZone: "UTC"},
+			time.Date(2026, 10, 24, 4, 59, 0, 0, time.UTC), true, time.Date(2026, 10, 31, 3, 0, 0, 0, time.UTC)},
+		{"cron after the duration", maintenanceWindow{Cron: "0 3 * * sat", Duration: 2 * time.Hour, TimeZone: "UTC"},
+			time.Date(2026, 10, 24, 5, 0, 0, 0, time.UTC), false, time.Date(2026, 10, 31, 3, 0, 0, 0, time.UTC)},
+		{"cron first day of the month", maintenanceWindow{Cron: "30 1 1 * *", Duration: time.Hour, TimeZone: "UTC"},
+			time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC), false, time.Date(2026, 11, 1, 1, 30, 0, 0, time.UTC)},
+		{"cron steps and names", maintenanceWindow{Cron: "*/20 9-17 * jan-mar mon-fri", Duration: 5 * time.Minute, TimeZone: "UTC"},
+			time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC), false, time.Date(2027, 1, 1, 9, 0, 0, 0, time.UTC)},
+		{"cron day of month or day of week", maintenanceWindow{Cron: "0 0 13 * 5", Duration: time.Hour, TimeZone: "UTC"},
+			time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC), false, time.Date(2026, 10, 23, 0, 0, 0, 0, time.UTC)},
+		{"cron sunday as 7", maintenanceWindow{Cron: "0 4 * * 7", Duration: time.Hour, TimeZone: "UTC"},
+			time.Date(2026, 10, 18, 4, 30, 0, 0, time.UTC), true, time.Date(2026, 10, 25, 4, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		if err := test.window.parse(); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if open := test.window.contains(test.at); open != test.expectedOpen {
+			t.Errorf("%s: contains(%s) returned %t, but we expected %t", test.name, test.at, open, test.expectedOpen)
+		}
+		if next := test.window.next(test.at); !next.Equal(test.expectedNext) {
+			t.Errorf("%s: next(%s) returned %s, but we expected %s", test.name, test.at, next, test.expectedNext)
+		}
+	}
+}
+
+func TestMaintenanceWindowInvalid(t *testing.T) {
+	tests := []maintenanceWindow{
+		{},
+		{Start: "02:00"},
+		{Start: "02:00", End: "02:00"},
+		{Start: "2am", End: "05:00"},
+		{Start: "02:00", End: "24:30"},
+		{Days: []string{"monday"}, Start: "02:00", End: "05:00"},
+		{Start: "02:00", End: "05:00", TimeZone: "Mars/Olympus_Mons"},
+		{Start: "02:00", End: "05:00", Duration: time.Hour},
+		{Cron: "0 3 * * sat"},
+		{Cron: "0 3 * *", Duration: time.Hour},
+		{Cron: "60 3 * * *", Duration: time.Hour},
+		{Cron: "0 5-3 * * *", Duration: time.Hour},
+		{Cron: "*/0 3 * * *", Duration: time.Hour},
+		{Cron: "0 3 * * sat", Duration: time.Hour, Start: "02:00"},
+	}
+	for _, window := range tests {
+		if err := window.parse(); err == nil {
+			t.Errorf("parse() accepted invalid maintenance window %+v", window)
+		}
+	}
+}
+
+func TestRestartOutsideMaintenanceWindow(t *testing.T) {
+	savedConfig := config
+	defer func() { config = savedConfig }()
+	queueFakeRestartResponses()
+
+	// a window which only opens in three days
+	closed := maintenanceWindow{Days: []string{weekdayNames[int(time.Now().UTC().AddDate(0, 0, 3).Weekday())]}, Start: "00:00", End: "24:00", TimeZone: "UTC"}
+	if err := closed.parse(); err != nil {
+		t.Fatal(err)
+	}
+	config.MaintenanceWindows = []maintenanceWindow{closed}
+	open, next := maintenanceWindowOpen(time.Now())
+	if open || next.IsZero() || time.Until(next) < 24*time.Hour {
+		t.Errorf("maintenanceWindowOpen returned %t %s, but we expected a window in three days", open, next)
+	}
+	if exitCode := doRestart(context.Background(), testReasons); exitCode != exitCodeOutsideMaintenanceWindow {
+		t.Errorf("doRestart returned exit code %d, but we expected %d", exitCode, exitCodeOutsideMaintenanceWindow)
+	}
+	fakeMutex.Lock()
+	if len(fakeRestartRequestIDs) != 0 {
+		t.Errorf("service received %d restart requests outside of the maintenance window", len(fakeRestartRequestIDs))
+	}
+	fakeMutex.Unlock()
+
+	// any open window allows the restart
+	always := maintenanceWindow{Start: "00:00", End: "24:00", TimeZone: "UTC"}
+	if err := always.parse(); err != nil {
+		t.Fatal(err)
+	}
+	config.MaintenanceWindows = []maintenanceWindow{closed, always}
+	if open, _ := maintenanceWindowOpen(time.Now()); !open {
+		t.Errorf("maintenanceWindowOpen returned false, but one window is always open")
+	}
+}
+
+// fakeNow lets now return the times one after another and the last time afterwards
+func fakeNow(t *testing.T, times ...time.Time) {
+	calls := 0
+	now = func() time.Time {
+		current := times[len(times)-1]
+		if calls < len(times) {
+			current = times[calls]
+		}
+		calls++
+		return current
+	}
+	t.Cleanup(func() { now = time.Now })
+}
+
+func TestMaintenanceWindowClosedAfterGoAhead(t *testing.T) {
+	savedConfig := config
+	defer func() { config = savedConfig }()
+	config.StateFile = filepath.Join(t.TempDir(), "state.json")
+	queueFakeRestartResponses("tests/goahead-true.json")
+	fakeMutex.Lock()
+	fakeAbortReports = nil
+	fakeMutex.Unlock()
+
+	window := maintenanceWindow{Days: []string{"mon"}, Start: "02:00", End: "04:00", TimeZone: "UTC"}
+	if err := window.parse(); err != nil {
+		t.Fatal(err)
+	}
+	config.MaintenanceWindows = []maintenanceWindow{window}
+	// the window is open when the restart is requested, but closed after the go ahead
+	fakeNow(t, time.Date(2026, 10, 19, 3, 59, 0, 0, time.UTC), time.Date(2026, 10, 19, 4, 0, 0, 0, time.UTC))
+
+	if exitCode := doRestart(context.Background(), testReasons); exitCode != exitCodeOutsideMaintenanceWindow {
+		t.Errorf("doRestart returned exit code %d, but we expected %d", exitCode, exitCodeOutsideMaintenanceWindow)
+	}
+	// the service releases the cluster lock after the abort report
+	fakeMutex.Lock()
+	if len(fakeAbortReports) != 1 || fakeAbortReports[0].RequestID != "sqEALyco" || fakeAbortReports[0].Phase != "maintenance_window" || fakeAbortReports[0].RestartReason != "testing" {
+		t.Errorf("service received the abort reports %+v, but we expected one for the closed maintenance window", fakeAbortReports)
+	}
+	fakeMutex.Unlock()
+	if state, err := readRestartState(config.StateFile); err != nil || state.Status != maintenanceWindowClosedStatus {
+		t.Errorf("persisted state is %+v with error %v, but we expected the status %s", state, err, maintenanceWindowClosedStatus)
+	}
+}